@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// admin serves the icecast compatible administration endpoints
+type admin struct {
+	User   string
+	Pass   string
+	mounts *mountList
+}
+
+type metadataRequest struct {
+	Mount string `json:"mount"`
+	Song  string `json:"song"`
+}
+
+// auth checks basic auth credentials, admin is disabled without a password
+func (a *admin) auth(w http.ResponseWriter, r *http.Request) bool {
+	if a.Pass == "" {
+		http.Error(w, "admin interface disabled", http.StatusForbidden)
+		return false
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(user), []byte(a.User)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pass), []byte(a.Pass)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dumb-mp3-streamer admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// metadata updates the current title, either the icecast way
+// with GET ?mode=updinfo&song=... or with a JSON POST body
+func (a *admin) metadata(w http.ResponseWriter, r *http.Request) {
+	if !a.auth(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if q.Get("mode") != "updinfo" {
+			http.Error(w, "unsupported mode", http.StatusBadRequest)
+			return
+		}
+		str, ok := a.mounts.lookup(w, q.Get("mount"))
+		if !ok {
+			return
+		}
+		str.setTitle(q.Get("song"))
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, "<?xml version=\"1.0\"?>\n<iceresponse><message>Metadata update successful</message><return>1</return></iceresponse>\n")
+	case http.MethodPost:
+		var req metadataRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		str, ok := a.mounts.lookup(w, req.Mount)
+		if !ok {
+			return
+		}
+		str.setTitle(req.Song)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(req)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type icecastListener struct {
+	ID        uint64 `xml:"id,attr"`
+	IP        string `xml:"IP"`
+	UserAgent string `xml:"UserAgent"`
+	Connected int64  `xml:"Connected"`
+	Sent      uint64 `xml:"BytesSent"`
+	Dropped   uint64 `xml:"DroppedChunks"`
+	Queued    int    `xml:"QueueDepth"`
+	Offset    int    `xml:"Offset,omitempty"`
+	ClientID  uint64 `xml:"ID"`
+}
+
+type icecastClients struct {
+	XMLName xml.Name `xml:"icestats"`
+	Source  struct {
+		Mount     string            `xml:"mount,attr"`
+		Listeners int               `xml:"Listeners"`
+		Listener  []icecastListener `xml:"listener"`
+	} `xml:"source"`
+}
+
+// listclients lists the listeners of a mount,
+// as Icecast XML or with ?format=json as JSON
+func (a *admin) listclients(w http.ResponseWriter, r *http.Request) {
+	if !a.auth(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	str, ok := a.mounts.lookup(w, q.Get("mount"))
+	if !ok {
+		return
+	}
+	list := str.sessions()
+	w.Header().Set("Cache-Control", "no-cache")
+	if q.Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Mount     string        `json:"mount"`
+			Listeners []sessionInfo `json:"listeners"`
+		}{str.Name, list})
+		return
+	}
+	var ic icecastClients
+	ic.Source.Mount = "/" + str.Name
+	ic.Source.Listeners = len(list)
+	now := time.Now()
+	for _, l := range list {
+		ic.Source.Listener = append(ic.Source.Listener, icecastListener{
+			ID:        l.ID,
+			IP:        l.Addr,
+			UserAgent: l.UserAgent,
+			Connected: int64(now.Sub(l.Connected) / time.Second),
+			Sent:      l.BytesSent,
+			Dropped:   l.Dropped,
+			Queued:    l.Queued,
+			Offset:    l.Offset,
+			ClientID:  l.ID,
+		})
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(w, "<?xml version=\"1.0\"?>\n")
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(ic)
+	fmt.Fprint(w, "\n")
+}
+
+// killclient disconnects a listener of the live stream by its id
+func (a *admin) killclient(w http.ResponseWriter, r *http.Request) {
+	if !a.auth(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	id, err := strconv.ParseUint(q.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad client id", http.StatusBadRequest)
+		return
+	}
+	str, ok := a.mounts.lookup(w, q.Get("mount"))
+	if !ok {
+		return
+	}
+	if !str.kill(id) {
+		http.Error(w, "client not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, "<?xml version=\"1.0\"?>\n<iceresponse><message>Client %d removed</message><return>1</return></iceresponse>\n", id)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"time"
+)
+
+var adtsSampleRates = [...]int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+var adtsProfiles = [...]string{"AAC Main", "AAC LC", "AAC SSR", "AAC LTP"}
+
+// adtsHeader is the fixed and variable header of an ADTS frame
+type adtsHeader []byte
+
+func (h adtsHeader) valid() bool {
+	return h[0] == 0xff && h[1]&0xf6 == 0xf0 &&
+		h.sampleRateIndex() < len(adtsSampleRates) &&
+		h.length() >= h.size()
+}
+
+// size is the header length, 9 with a CRC
+func (h adtsHeader) size() int {
+	if h[1]&0x01 == 0 {
+		return 9
+	}
+	return 7
+}
+
+func (h adtsHeader) profile() string {
+	return adtsProfiles[h[2]>>6]
+}
+
+func (h adtsHeader) sampleRateIndex() int {
+	return int(h[2]>>2) & 0x0f
+}
+
+func (h adtsHeader) sampleRate() int {
+	return adtsSampleRates[h.sampleRateIndex()]
+}
+
+func (h adtsHeader) channels() int {
+	c := int(h[2]&0x01)<<2 | int(h[3]>>6)
+	switch c {
+	case 0:
+		// Described by a program config element, assume stereo
+		return 2
+	case 7:
+		return 8
+	}
+	return c
+}
+
+// length is the frame length including the header
+func (h adtsHeader) length() int {
+	return int(h[3]&0x03)<<11 | int(h[4])<<3 | int(h[5]>>5)
+}
+
+// samples per frame, each raw data block is 1024. With HE-AAC the header
+// describes the core stream at half the rate, so this still adds up
+func (h adtsHeader) samples() int {
+	return (int(h[6]&0x03) + 1) * 1024
+}
+
+// adtsDecoder splits an AAC ADTS stream into frames, like mp3.Decoder does for mp3
+type adtsDecoder struct {
+	r *bufio.Reader
+}
+
+func newADTSDecoder(r io.Reader) *adtsDecoder {
+	return &adtsDecoder{
+		r: bufio.NewReader(r),
+	}
+}
+
+func (d *adtsDecoder) next() (frame, error) {
+	var skipped int
+	for {
+		b, err := d.r.Peek(7)
+		if err != nil {
+			return frame{}, err
+		}
+		h := adtsHeader(b)
+		if !h.valid() {
+			d.r.Discard(1)
+			skipped++
+			continue
+		}
+		buf := make([]byte, h.length())
+		if _, err := io.ReadFull(d.r, buf); err != nil {
+			return frame{}, err
+		}
+		h = adtsHeader(buf)
+		sr := h.sampleRate()
+		return frame{
+			data: buf,
+			dur:  time.Duration(h.samples()) * time.Second / time.Duration(sr),
+			format: audioFormat{
+				Codec:      h.profile(),
+				SampleRate: sr,
+				Channels:   h.channels(),
+			},
+			skipped: skipped,
+		}, nil
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// adtsFrame builds an ADTS frame of length bytes, header included
+func adtsFrame(profile, rateIndex, channels, length, blocks int, crc bool) []byte {
+	f := make([]byte, length)
+	f[0] = 0xff
+	f[1] = 0xf1
+	if crc {
+		f[1] = 0xf0
+	}
+	f[2] = byte(profile<<6 | rateIndex<<2 | channels>>2)
+	f[3] = byte((channels&3)<<6 | length>>11)
+	f[4] = byte(length >> 3)
+	f[5] = byte((length&7)<<5 | 0x1f)
+	f[6] = 0xfc | byte(blocks-1)
+	return f
+}
+
+func TestADTSHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    []byte
+		valid    bool
+		profile  string
+		rate     int
+		channels int
+		length   int
+		size     int
+		samples  int
+	}{
+		{"LC 44.1k stereo", adtsFrame(1, 4, 2, 371, 1, false), true, "AAC LC", 44100, 2, 371, 7, 1024},
+		{"Main 48k mono with CRC", adtsFrame(0, 3, 1, 200, 1, true), true, "AAC Main", 48000, 1, 200, 9, 1024},
+		{"7.1", adtsFrame(1, 3, 7, 1500, 1, false), true, "AAC LC", 48000, 8, 1500, 7, 1024},
+		{"PCE channels", adtsFrame(1, 6, 0, 100, 1, false), true, "AAC LC", 24000, 2, 100, 7, 1024},
+		{"four blocks", adtsFrame(1, 12, 2, 8191, 4, false), true, "AAC LC", 7350, 2, 8191, 7, 4096},
+		{"bad rate index", adtsFrame(1, 13, 2, 371, 1, false), false, "", 0, 0, 0, 0, 0},
+		{"shorter than the header", adtsFrame(1, 4, 2, 8, 1, true), false, "", 0, 0, 0, 0, 0},
+		{"not a sync word", []byte{0xff, 0xe1, 0x50, 0x80, 0x2e, 0x7f, 0xfc}, false, "", 0, 0, 0, 0, 0},
+		{"mp3 header", []byte{0xff, 0xfb, 0x90, 0x00, 0x00, 0x00, 0x00}, false, "", 0, 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		h := adtsHeader(tt.frame)
+		if h.valid() != tt.valid {
+			t.Errorf("%s: valid %v, want %v", tt.name, h.valid(), tt.valid)
+			continue
+		}
+		if !tt.valid {
+			continue
+		}
+		if h.profile() != tt.profile || h.sampleRate() != tt.rate || h.channels() != tt.channels {
+			t.Errorf("%s: %s %d Hz %d channels, want %s %d Hz %d channels", tt.name,
+				h.profile(), h.sampleRate(), h.channels(), tt.profile, tt.rate, tt.channels)
+		}
+		if h.length() != tt.length || h.size() != tt.size || h.samples() != tt.samples {
+			t.Errorf("%s: length %d, header %d, %d samples, want %d, %d, %d", tt.name,
+				h.length(), h.size(), h.samples(), tt.length, tt.size, tt.samples)
+		}
+	}
+}
+
+func TestADTSDecoder(t *testing.T) {
+	var in bytes.Buffer
+	in.WriteString("garbage")
+	in.Write(adtsFrame(1, 4, 2, 300, 1, false))
+	in.Write(adtsFrame(1, 4, 2, 301, 1, false))
+	// A false sync word between frames
+	in.Write([]byte{0xff, 0xf1, 0xff})
+	in.Write(adtsFrame(1, 3, 1, 302, 2, true))
+	// Cut short
+	in.Write(adtsFrame(1, 4, 2, 400, 1, false)[:100])
+
+	dec := newADTSDecoder(&in)
+	want := []struct {
+		size    int
+		skipped int
+		dur     time.Duration
+		rate    int
+	}{
+		{300, 7, 1024 * time.Second / 44100, 44100},
+		{301, 0, 1024 * time.Second / 44100, 44100},
+		{302, 3, 2048 * time.Second / 48000, 48000},
+	}
+	for i, w := range want {
+		f, err := dec.next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if len(f.data) != w.size || f.skipped != w.skipped || f.dur != w.dur || f.format.SampleRate != w.rate {
+			t.Errorf("frame %d: %d bytes, %d skipped, %v at %d Hz, want %d, %d, %v at %d Hz", i,
+				len(f.data), f.skipped, f.dur, f.format.SampleRate, w.size, w.skipped, w.dur, w.rate)
+		}
+	}
+	if _, err := dec.next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated frame: err %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
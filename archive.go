@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// strftime formats t by a template with the usual strftime verbs,
+// plus %t for the stream title
+func strftime(tmpl string, t time.Time, title string) string {
+	var b strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' || i+1 == len(tmpl) {
+			b.WriteByte(tmpl[i])
+			continue
+		}
+		i++
+		switch tmpl[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", t.Month())
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case 't':
+			b.WriteString(fileName(title))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(tmpl[i])
+		}
+	}
+	return b.String()
+}
+
+// fileName makes a title safe to use in a file name
+func fileName(title string) string {
+	if title == "" {
+		return "untitled"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|', 0:
+			return '_'
+		}
+		return r
+	}, title)
+}
+
+// archiveConfig is how mounts get archived, no Dir means they don't
+type archiveConfig struct {
+	Dir     string
+	Name    string
+	MaxAge  time.Duration
+	MaxSize int64
+}
+
+// archive records a stream exactly as it's sent, to files named by a
+// template. A new file starts whenever the name changes, so %H makes a
+// file an hour and %t one a show. Old files go by age and total size
+type archive struct {
+	dir     string
+	tmpl    string
+	ext     string
+	head    func() []byte
+	maxAge  time.Duration
+	maxSize int64
+	name    string
+	file    *os.File
+	// Only the first write error gets logged
+	failed bool
+}
+
+func newArchive(dir, tmpl, ext string, head func() []byte, maxAge time.Duration, maxSize int64) (*archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &archive{
+		dir:     dir,
+		tmpl:    tmpl,
+		ext:     ext,
+		head:    head,
+		maxAge:  maxAge,
+		maxSize: maxSize,
+	}, nil
+}
+
+// write appends the data sent at time now
+func (a *archive) write(data []byte, now time.Time, title string) {
+	if err := a.append(data, now, title); err != nil && !a.failed {
+		a.failed = true
+		log.Printf("archive: %v\n", err)
+	}
+}
+
+func (a *archive) append(data []byte, now time.Time, title string) error {
+	name := strftime(a.tmpl, now, title) + "." + a.ext
+	if a.file == nil || name != a.name {
+		if err := a.rotate(name); err != nil {
+			return err
+		}
+	}
+	_, err := a.file.Write(data)
+	return err
+}
+
+// rotate moves on to the file name, a file that's there
+// already from before a restart is added to
+func (a *archive) rotate(name string) error {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	path := filepath.Join(a.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	a.name = name
+	a.failed = false
+	if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+		if _, err := f.Write(a.head()); err != nil {
+			return err
+		}
+	}
+	a.expire(path)
+	return nil
+}
+
+// expire removes files older than maxAge, then the oldest files
+// until what's left fits in maxSize. The current file stays
+func (a *archive) expire(current string) {
+	if a.maxAge <= 0 && a.maxSize <= 0 {
+		return
+	}
+	type archived struct {
+		path string
+		mod  time.Time
+		size int64
+	}
+	var files []archived
+	var total int64
+	filepath.Walk(a.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || path == current || !strings.HasSuffix(path, "."+a.ext) {
+			return nil
+		}
+		files = append(files, archived{path, fi.ModTime(), fi.Size()})
+		total += fi.Size()
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mod.Before(files[j].mod)
+	})
+	if fi, err := os.Stat(current); err == nil {
+		total += fi.Size()
+	}
+	for _, f := range files {
+		old := a.maxAge > 0 && time.Since(f.mod) > a.maxAge
+		big := a.maxSize > 0 && total > a.maxSize
+		if !old && !big {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("archive: %v\n", err)
+			continue
+		}
+		log.Printf("archive: removed %s\n", f.path)
+		total -= f.size
+	}
+}
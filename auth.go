@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userFlag collects repeated -listenuser user:pass flags
+type userFlag map[string]string
+
+func (u userFlag) String() string {
+	var s []string
+	for user := range u {
+		s = append(s, user)
+	}
+	return strings.Join(s, ",")
+}
+
+func (u userFlag) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i < 1 {
+		return fmt.Errorf("expected user:pass, got %q", v)
+	}
+	u[v[:i]] = v[i+1:]
+	return nil
+}
+
+// htpasswd holds the users of an htpasswd file, it's read again
+// when it changes so members can be added without a restart
+type htpasswd struct {
+	sync.Mutex
+	path  string
+	mod   time.Time
+	users map[string]string
+}
+
+func newHtpasswd(path string) (*htpasswd, error) {
+	h := &htpasswd{path: path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.load(fi.ModTime()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the file, only bcrypt and SHA1 hashes are supported
+func (h *htpasswd) load(mod time.Time) error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return fmt.Errorf("%s:%d: expected user:hash", h.path, n)
+		}
+		hash := line[i+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("%s:%d: unsupported hash, use bcrypt (htpasswd -B) or SHA1 (htpasswd -s)", h.path, n)
+		}
+		users[line[:i]] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	h.users = users
+	h.mod = mod
+	return nil
+}
+
+func (h *htpasswd) check(user, pass string) bool {
+	h.Lock()
+	defer h.Unlock()
+	if fi, err := os.Stat(h.path); err == nil && !fi.ModTime().Equal(h.mod) {
+		// A broken file keeps the users it had, until it changes again
+		if err := h.load(fi.ModTime()); err != nil {
+			log.Printf("htpasswd: %v\n", err)
+			h.mod = fi.ModTime()
+		}
+	}
+	hash, ok := h.users[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+// How long the answer of the URL holds for an HLS listener
+const hlsAuthTime = 30 * time.Second
+
+// hlsGrant is an answer of the URL kept for an HLS listener
+type hlsGrant struct {
+	ok    bool
+	msg   string
+	until time.Time
+}
+
+// listenAuth decides who gets to listen. With users or an htpasswd file
+// listeners need basic auth credentials, with a URL every connection is
+// approved there the way Icecast does with listener_add
+type listenAuth struct {
+	sync.Mutex
+	Users    userFlag
+	Htpasswd *htpasswd
+	URL      string
+	client   *http.Client
+	// Answers for HLS listeners by mount, credentials and address
+	grants map[[sha256.Size]byte]hlsGrant
+}
+
+func newListenAuth(users userFlag, htpasswd *htpasswd, authURL string) *listenAuth {
+	if len(users) == 0 && htpasswd == nil && authURL == "" {
+		return nil
+	}
+	return &listenAuth{
+		Users:    users,
+		Htpasswd: htpasswd,
+		URL:      authURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		grants:   make(map[[sha256.Size]byte]hlsGrant),
+	}
+}
+
+// password checks the basic auth credentials of a request,
+// there's nothing to check if only the URL is used
+func (a *listenAuth) password(r *http.Request) bool {
+	if len(a.Users) == 0 && a.Htpasswd == nil {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	if p, ok := a.Users[user]; ok && subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1 {
+		return true
+	}
+	return a.Htpasswd != nil && a.Htpasswd.check(user, pass)
+}
+
+// checkPassword replies with 401 if the credentials don't check out
+func (a *listenAuth) checkPassword(w http.ResponseWriter, r *http.Request) bool {
+	if a.password(r) {
+		return true
+	}
+	a.unauthorized(w, "unauthorized")
+	return false
+}
+
+func (a *listenAuth) unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="dumb-mp3-streamer"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// hook posts a listener_add or listener_remove to the URL with
+// what Icecast sends along
+func (a *listenAuth) hook(action string, r *http.Request, mount string, id uint64, extra url.Values) (*http.Response, error) {
+	user, pass, _ := r.BasicAuth()
+	server, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		server, port = r.Host, ""
+	}
+	form := url.Values{
+		"action": {action},
+		"server": {server},
+		"port":   {port},
+		"client": {strconv.FormatUint(id, 10)},
+		"mount":  {"/" + mount},
+		"user":   {user},
+		"pass":   {pass},
+		"ip":     {remoteAddr(r)},
+		"agent":  {r.UserAgent()},
+	}
+	for k, v := range extra {
+		form[k] = v
+	}
+	return a.client.PostForm(a.URL, form)
+}
+
+// add asks the URL about a listener with a listener_add, it approves
+// with an "icecast-auth-user: 1" header or says why not
+func (a *listenAuth) add(r *http.Request, mount string, id uint64) (ok bool, msg string, err error) {
+	resp, err := a.hook("listener_add", r, mount, id, nil)
+	if err != nil {
+		return false, "", err
+	}
+	resp.Body.Close()
+	if resp.Header.Get("icecast-auth-user") == "1" {
+		return true, "", nil
+	}
+	msg = resp.Header.Get("icecast-auth-message")
+	if msg == "" {
+		msg = "unauthorized"
+	}
+	return false, msg, nil
+}
+
+// allow checks a listener before it's sent anything, replying if it's
+// turned down
+func (a *listenAuth) allow(w http.ResponseWriter, r *http.Request, mount string, id uint64) bool {
+	if !a.checkPassword(w, r) {
+		return false
+	}
+	if a.URL == "" {
+		return true
+	}
+	ok, msg, err := a.add(r, mount, id)
+	if err != nil {
+		log.Printf("%s: listener auth: %v\n", mount, err)
+		http.Error(w, "listener auth failed", http.StatusServiceUnavailable)
+		return false
+	}
+	if !ok {
+		a.unauthorized(w, msg)
+	}
+	return ok
+}
+
+// allowHLS checks a request for a playlist or a segment. HLS players
+// don't stay connected, so the answer of the URL is kept for a while
+// and it isn't told when they leave
+func (s *streamer) allowHLS(w http.ResponseWriter, r *http.Request) bool {
+	a := s.Auth
+	if a == nil {
+		return true
+	}
+	if !a.checkPassword(w, r) {
+		return false
+	}
+	if a.URL == "" {
+		return true
+	}
+	user, pass, _ := r.BasicAuth()
+	key := sha256.Sum256([]byte(strings.Join([]string{s.Name, user, pass, remoteAddr(r)}, "\x00")))
+	now := time.Now()
+	a.Lock()
+	g, ok := a.grants[key]
+	a.Unlock()
+	if !ok || now.After(g.until) {
+		var err error
+		g.ok, g.msg, err = a.add(r, s.Name, s.newID())
+		if err != nil {
+			log.Printf("%s: listener auth: %v\n", s.Name, err)
+			http.Error(w, "listener auth failed", http.StatusServiceUnavailable)
+			return false
+		}
+		g.until = now.Add(hlsAuthTime)
+		a.Lock()
+		for k, old := range a.grants {
+			if now.After(old.until) {
+				delete(a.grants, k)
+			}
+		}
+		a.grants[key] = g
+		a.Unlock()
+	}
+	if !g.ok {
+		a.unauthorized(w, g.msg)
+	}
+	return g.ok
+}
+
+// admit lets a listener of a mount in or replies why not,
+// leave is deferred so the auth URL hears when it's gone
+func (s *streamer) admit(w http.ResponseWriter, r *http.Request, id uint64) (leave func(), ok bool) {
+	if s.Auth == nil {
+		return func() {}, true
+	}
+	if !s.Auth.allow(w, r, s.Name, id) {
+		return nil, false
+	}
+	start := time.Now()
+	return func() { s.Auth.leave(r, s.Name, id, start) }, true
+}
+
+// leave tells the URL that a listener it approved has gone
+func (a *listenAuth) leave(r *http.Request, mount string, id uint64, start time.Time) {
+	if a.URL == "" {
+		return
+	}
+	dur := strconv.Itoa(int(time.Since(start) / time.Second))
+	resp, err := a.hook("listener_remove", r, mount, id, url.Values{"duration": {dur}})
+	if err != nil {
+		log.Printf("%s: listener auth: %v\n", mount, err)
+		return
+	}
+	resp.Body.Close()
+}
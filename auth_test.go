@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authBackend stands in for an Icecast style auth URL,
+// reply sets the headers of its answer to a listener_add
+type authBackend struct {
+	sync.Mutex
+	forms []url.Values
+	reply func(form url.Values, h http.Header)
+}
+
+func (b *authBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	b.Lock()
+	b.forms = append(b.forms, r.PostForm)
+	b.Unlock()
+	if r.PostForm.Get("action") == "listener_add" {
+		b.reply(r.PostForm, w.Header())
+	}
+}
+
+func listenerRequest(user, pass string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://radio.example:8080/stream", nil)
+	r.RemoteAddr = "192.0.2.7:5555"
+	r.Header.Set("User-Agent", "test player")
+	if user != "" {
+		r.SetBasicAuth(user, pass)
+	}
+	return r
+}
+
+func TestListenerAddRemove(t *testing.T) {
+	backend := &authBackend{reply: func(form url.Values, h http.Header) {
+		if form.Get("user") == "member" && form.Get("pass") == "secret" {
+			h.Set("icecast-auth-user", "1")
+		}
+	}}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	s := &streamer{Name: "stream", Auth: newListenAuth(nil, nil, srv.URL)}
+	w := httptest.NewRecorder()
+	r := listenerRequest("member", "secret")
+	leave, ok := s.admit(w, r, 42)
+	if !ok {
+		t.Fatalf("member turned down: %d %s", w.Code, w.Body)
+	}
+	leave()
+
+	if len(backend.forms) != 2 {
+		t.Fatalf("%d calls to the auth URL, want 2", len(backend.forms))
+	}
+	add, remove := backend.forms[0], backend.forms[1]
+	want := map[string]string{
+		"action": "listener_add",
+		"server": "radio.example",
+		"port":   "8080",
+		"client": "42",
+		"mount":  "/stream",
+		"user":   "member",
+		"pass":   "secret",
+		"ip":     "192.0.2.7",
+		"agent":  "test player",
+	}
+	for k, v := range want {
+		if add.Get(k) != v {
+			t.Errorf("listener_add %s = %q, want %q", k, add.Get(k), v)
+		}
+	}
+	want["action"] = "listener_remove"
+	want["duration"] = "0"
+	for k, v := range want {
+		if remove.Get(k) != v {
+			t.Errorf("listener_remove %s = %q, want %q", k, remove.Get(k), v)
+		}
+	}
+}
+
+func TestListenerAddReplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		code    int
+		body    string
+	}{
+		{"approved", map[string]string{"icecast-auth-user": "1"}, http.StatusOK, ""},
+		{"turned down", nil, http.StatusUnauthorized, "unauthorized"},
+		{"turned down with a reason", map[string]string{"icecast-auth-message": "membership expired"}, http.StatusUnauthorized, "membership expired"},
+		{"not a 1", map[string]string{"icecast-auth-user": "0"}, http.StatusUnauthorized, "unauthorized"},
+	}
+	for _, tt := range tests {
+		backend := &authBackend{reply: func(form url.Values, h http.Header) {
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+		}}
+		srv := httptest.NewServer(backend)
+		s := &streamer{Name: "stream", Auth: newListenAuth(nil, nil, srv.URL)}
+		w := httptest.NewRecorder()
+		leave, ok := s.admit(w, listenerRequest("", ""), 1)
+		if ok {
+			leave()
+			w.WriteHeader(http.StatusOK)
+		}
+		srv.Close()
+		if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, w.Code, w.Body, tt.code, tt.body)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate", tt.name)
+		}
+		// Who wasn't let in didn't leave either
+		if !ok && len(backend.forms) != 1 {
+			t.Errorf("%s: %d calls to the auth URL, want 1", tt.name, len(backend.forms))
+		}
+	}
+}
+
+func TestListenerAddUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	s := &streamer{Name: "stream", Auth: newListenAuth(nil, nil, srv.URL)}
+	w := httptest.NewRecorder()
+	if _, ok := s.admit(w, listenerRequest("member", "secret"), 1); ok {
+		t.Fatal("let in without an answer from the auth URL")
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("%d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// The URL isn't asked about who doesn't have the password
+func TestListenerAddAfterPassword(t *testing.T) {
+	backend := &authBackend{reply: func(form url.Values, h http.Header) {
+		h.Set("icecast-auth-user", "1")
+	}}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+	s := &streamer{Name: "stream", Auth: newListenAuth(userFlag{"member": "secret"}, nil, srv.URL)}
+	w := httptest.NewRecorder()
+	if _, ok := s.admit(w, listenerRequest("member", "wrong"), 1); ok || w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %v %d", ok, w.Code)
+	}
+	if len(backend.forms) != 0 {
+		t.Errorf("%d calls to the auth URL, want 0", len(backend.forms))
+	}
+	leave, ok := s.admit(httptest.NewRecorder(), listenerRequest("member", "secret"), 2)
+	if !ok {
+		t.Fatal("member turned down")
+	}
+	leave()
+	if len(backend.forms) != 2 {
+		t.Errorf("%d calls to the auth URL, want 2", len(backend.forms))
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "members")
+	sum := sha1.Sum([]byte("shapass"))
+	bc, err := bcrypt.GenerateFromPassword([]byte("bcpass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := "# members\nsha:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n\nbc:" + string(bc) + "\n"
+	if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newListenAuth(userFlag{"static": "pw"}, h, "")
+	tests := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"sha", "shapass", true},
+		{"sha", "bcpass", false},
+		{"bc", "bcpass", true},
+		{"bc", "shapass", false},
+		{"static", "pw", true},
+		{"static", "", false},
+		{"nobody", "shapass", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if ok := a.password(listenerRequest(tt.user, tt.pass)); ok != tt.ok {
+			t.Errorf("%s:%s let in %v, want %v", tt.user, tt.pass, ok, tt.ok)
+		}
+	}
+
+	// A new member, then a broken file that keeps the members there were
+	sum = sha1.Sum([]byte("new"))
+	file += "new:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n"
+	if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if !h.check("new", "new") {
+		t.Error("new member not let in after the file changed")
+	}
+	if err := ioutil.WriteFile(path, []byte("apr1:$apr1$xyz\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if !h.check("new", "new") || h.check("apr1", "") {
+		t.Error("broken file changed the members")
+	}
+}
+
+func TestHtpasswdUnsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, line := range []string{"md5:$apr1$abc$def", "crypt:abCDefGhIjKlM", "nohash"} {
+		path := filepath.Join(dir, "members")
+		if err := ioutil.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newHtpasswd(path); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+// HLS players fetch every few seconds, the URL is asked once in a while
+func TestAllowHLS(t *testing.T) {
+	backend := &authBackend{reply: func(form url.Values, h http.Header) {
+		if form.Get("user") == "member" {
+			h.Set("icecast-auth-user", "1")
+		} else {
+			h.Set("icecast-auth-message", "banned")
+		}
+	}}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+	s := &streamer{Name: "stream", Auth: newListenAuth(nil, nil, srv.URL)}
+
+	tests := []struct {
+		name  string
+		user  string
+		addr  string
+		code  int
+		calls int
+	}{
+		{"member", "member", "192.0.2.7:5555", http.StatusOK, 1},
+		{"member again", "member", "192.0.2.7:6666", http.StatusOK, 1},
+		{"member somewhere else", "member", "198.51.100.1:5555", http.StatusOK, 2},
+		{"banned", "troll", "192.0.2.7:5555", http.StatusUnauthorized, 3},
+		{"banned again", "troll", "192.0.2.7:5555", http.StatusUnauthorized, 3},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := listenerRequest(tt.user, "pw")
+		r.RemoteAddr = tt.addr
+		if s.allowHLS(w, r) {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != tt.code || len(backend.forms) != tt.calls {
+			t.Errorf("%s: %d after %d calls, want %d after %d", tt.name, w.Code, len(backend.forms), tt.code, tt.calls)
+		}
+		if tt.code == http.StatusUnauthorized && !strings.Contains(w.Body.String(), "banned") {
+			t.Errorf("%s: %q", tt.name, w.Body)
+		}
+	}
+	for _, f := range backend.forms {
+		if f.Get("action") != "listener_add" || f.Get("mount") != "/stream" {
+			t.Errorf("%s of %s", f.Get("action"), f.Get("mount"))
+		}
+	}
+
+	// Answers run out
+	a := s.Auth
+	a.Lock()
+	for k, g := range a.grants {
+		g.until = time.Now().Add(-time.Second)
+		a.grants[k] = g
+	}
+	a.Unlock()
+	if !s.allowHLS(httptest.NewRecorder(), listenerRequest("member", "pw")) || len(backend.forms) != 4 {
+		t.Errorf("%d calls after the answers ran out, want 4", len(backend.forms))
+	}
+	if len(a.grants) != 1 {
+		t.Errorf("%d answers kept, want 1", len(a.grants))
+	}
+}
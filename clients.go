@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// session is a listener of the live stream or of the time-shift,
+// its counters are counted without the lock of the streamer
+type session struct {
+	ch        chan []byte
+	rc        *http.ResponseController
+	addr      string
+	agent     string
+	connected time.Time
+	// How far back in time a time-shifted listener started
+	offset  time.Duration
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// sessionInfo is what /admin/listclients reports about a listener
+type sessionInfo struct {
+	ID        uint64    `json:"id"`
+	Addr      string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Connected time.Time `json:"connected"`
+	BytesSent uint64    `json:"bytes_sent"`
+	Dropped   uint64    `json:"dropped_chunks"`
+	Queued    int       `json:"queue_depth"`
+	// Seconds back in time, for time-shifted listeners
+	Offset int `json:"offset,omitempty"`
+}
+
+// remoteAddr is the address of the client
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// fromProxy takes the address of clients from the X-Forwarded-For header
+// of the reverse proxy in front. Clients can send the header themselves,
+// so it's the last address, the one the proxy added
+func fromProxy(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("X-Forwarded-For"); v != "" {
+			list := strings.Split(v, ",")
+			if addr := strings.TrimSpace(list[len(list)-1]); addr != "" {
+				r.RemoteAddr = addr
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func newSession(w http.ResponseWriter, r *http.Request, queue int) *session {
+	return &session{
+		ch:        make(chan []byte, queue),
+		rc:        http.NewResponseController(w),
+		addr:      remoteAddr(r),
+		agent:     r.UserAgent(),
+		connected: time.Now(),
+	}
+}
+
+// sessions lists the listeners by id, time-shifted ones too
+func (s *streamer) sessions() []sessionInfo {
+	s.RLock()
+	defer s.RUnlock()
+	list := []sessionInfo{}
+	for _, m := range []map[uint64]*session{s.clients, s.shifted} {
+		for id, c := range m {
+			list = append(list, sessionInfo{
+				ID:        id,
+				Addr:      c.addr,
+				UserAgent: c.agent,
+				Connected: c.connected,
+				BytesSent: c.sent.Load(),
+				Dropped:   c.dropped.Load(),
+				Queued:    len(c.ch),
+				Offset:    int(c.offset / time.Second),
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// kill disconnects a listener right away, a write it's stuck in
+// fails along with whatever is still queued for it
+func (s *streamer) kill(id uint64) bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, m := range []map[uint64]*session{s.clients, s.shifted} {
+		if c, ok := m[id]; ok {
+			c.rc.SetWriteDeadline(time.Now())
+			close(c.ch)
+			delete(m, id)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	tests := []struct {
+		name  string
+		trust bool
+		fwd   string
+		addr  string
+	}{
+		{"no proxy", false, "", "192.0.2.7"},
+		{"header not trusted", false, "198.51.100.1", "192.0.2.7"},
+		{"proxy", true, "198.51.100.1", "198.51.100.1"},
+		{"header sent along to the proxy", true, "203.0.113.9, 198.51.100.1", "198.51.100.1"},
+		{"proxy without the header", true, "", "192.0.2.7"},
+	}
+	for _, tt := range tests {
+		var got string
+		var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = remoteAddr(r)
+		})
+		if tt.trust {
+			h = fromProxy(h)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		r.RemoteAddr = "192.0.2.7:5555"
+		if tt.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tt.fwd)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != tt.addr {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.addr)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := &streamer{
+		clients: make(map[uint64]*session),
+		shifted: make(map[uint64]*session),
+	}
+	r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	s.clients[1] = newSession(httptest.NewRecorder(), r, 10)
+	s.clients[3] = newSession(httptest.NewRecorder(), r, 10)
+	shifted := newSession(httptest.NewRecorder(), r, 0)
+	shifted.offset = -600 * time.Second
+	s.addShifted(2, shifted)
+	s.clients[1].ch <- []byte("queued")
+
+	list := s.sessions()
+	if len(list) != 3 || s.listeners() != 3 {
+		t.Fatalf("%d sessions of %d listeners, want 3", len(list), s.listeners())
+	}
+	for i, l := range list {
+		if l.ID != uint64(i+1) {
+			t.Errorf("session %d has id %d", i, l.ID)
+		}
+	}
+	if list[0].Queued != 1 || list[1].Offset != -600 || list[2].Offset != 0 {
+		t.Errorf("%+v", list)
+	}
+
+	for _, id := range []uint64{2, 1} {
+		if !s.kill(id) {
+			t.Errorf("%d not killed", id)
+		}
+	}
+	if s.kill(2) {
+		t.Error("2 killed twice")
+	}
+	if _, ok := <-shifted.ch; ok {
+		t.Error("time-shifted session not closed")
+	}
+	// Its own goroutine ending removes it again
+	s.delShifted(2)
+	if list := s.sessions(); len(list) != 1 || list[0].ID != 3 {
+		t.Errorf("%+v left", list)
+	}
+}
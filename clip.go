@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tcolgate/mp3"
+)
+
+// Longest clip /clip cuts
+const maxClip = time.Hour
+
+// clipRange is a stretch of wall clock time
+type clipRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// ranges lists the stretches of time the time-shift has kept,
+// segments that follow each other without a gap make one
+func (t *timeShift) ranges() []clipRange {
+	t.RLock()
+	defer t.RUnlock()
+	var rs []clipRange
+	for _, seg := range t.segs {
+		r := clipRange{seg.at, seg.at.Add(seg.dur)}
+		if n := len(rs); n > 0 && r.From.Sub(rs[n-1].To) < time.Second {
+			rs[n-1].To = r.To
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+// clipPart is a chunk of a clip, left on disk until it's written.
+// Chunks at the edges get cut frame by frame and are kept as data
+type clipPart struct {
+	f    *os.File
+	off  int64
+	size int
+	data []byte
+}
+
+// clipFile is a clip worked out from the time-shift records, its
+// segments are kept open so they can't expire before it's written
+type clipFile struct {
+	parts []clipPart
+	files []*os.File
+	size  int64
+}
+
+// clip finds the frames that play between from and to, in a pass over
+// the record headers. Records past where a segment was when the pass
+// got to it are left out, they're still being written
+func (t *timeShift) clip(from, to time.Time) (*clipFile, error) {
+	t.RLock()
+	var segs []segment
+	for _, seg := range t.segs {
+		if seg.at.Before(to) && seg.at.Add(seg.dur).After(from) {
+			segs = append(segs, *seg)
+		}
+	}
+	t.RUnlock()
+	cf := &clipFile{}
+	for _, seg := range segs {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			cf.Close()
+			return nil, err
+		}
+		cf.files = append(cf.files, f)
+		fi, err := f.Stat()
+		if err != nil {
+			cf.Close()
+			return nil, err
+		}
+		var off int64
+		at := seg.at
+		for at.Before(to) {
+			var h [recordHead]byte
+			if _, err := f.ReadAt(h[:], off); err != nil {
+				break
+			}
+			dur := time.Duration(binary.BigEndian.Uint64(h[:]))
+			size := int(binary.BigEndian.Uint32(h[8:]))
+			off += recordHead
+			if off+int64(size) > fi.Size() {
+				break
+			}
+			end := at.Add(dur)
+			switch {
+			case !end.After(from):
+			case !at.Before(from) && !end.After(to):
+				cf.parts = append(cf.parts, clipPart{f: f, off: off, size: size})
+				cf.size += int64(size)
+			default:
+				data := make([]byte, size)
+				if _, err := f.ReadAt(data, off); err != nil {
+					cf.Close()
+					return nil, err
+				}
+				data = cutFrames(data, at, from, to)
+				cf.parts = append(cf.parts, clipPart{data: data})
+				cf.size += int64(len(data))
+			}
+			off += int64(size)
+			at = end
+		}
+	}
+	return cf, nil
+}
+
+// cutFrames keeps the frames of an mp3 chunk starting at at
+// that play between from and to
+func cutFrames(data []byte, at, from, to time.Time) []byte {
+	var cut []byte
+	dec := mp3.NewDecoder(bytes.NewReader(data))
+	var f mp3.Frame
+	var skipped int
+	for dec.Decode(&f, &skipped) == nil {
+		end := at.Add(f.Duration())
+		if end.After(from) && at.Before(to) {
+			cut = append(cut, frameBytes(&f)...)
+		}
+		at = end
+	}
+	return cut
+}
+
+// WriteTo writes the clip out chunk by chunk
+func (cf *clipFile) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	var buf []byte
+	for _, p := range cf.parts {
+		data := p.data
+		if p.f != nil {
+			if cap(buf) < p.size {
+				buf = make([]byte, p.size)
+			}
+			data = buf[:p.size]
+			if _, err := p.f.ReadAt(data, p.off); err != nil {
+				return n, err
+			}
+		}
+		m, err := w.Write(data)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (cf *clipFile) Close() error {
+	for _, f := range cf.files {
+		f.Close()
+	}
+	return nil
+}
+
+// clips cuts files out of the time-shift of mp3 mounts
+type clips struct {
+	mounts *mountList
+}
+
+// shifted finds the mount of a request and checks it can be clipped,
+// and by whom. leave is deferred like for listeners
+func (c *clips) shifted(w http.ResponseWriter, r *http.Request) (str *streamer, leave func(), ok bool) {
+	str, ok = c.mounts.lookup(w, r.URL.Query().Get("mount"))
+	if !ok {
+		return nil, nil, false
+	}
+	if str.shift == nil {
+		http.Error(w, "time-shift is disabled, clips need -timeshift", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if str.Codec.name != "mp3" {
+		http.Error(w, "clips are mp3 only", http.StatusNotFound)
+		return nil, nil, false
+	}
+	leave, ok = str.admit(w, r, str.newID())
+	return str, leave, ok
+}
+
+// list replies with the ranges a mount can be clipped from
+func (c *clips) list(w http.ResponseWriter, r *http.Request) {
+	str, leave, ok := c.shifted(w, r)
+	if !ok {
+		return
+	}
+	defer leave()
+	ranges := str.shift.ranges()
+	if ranges == nil {
+		ranges = []clipRange{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Mount  string      `json:"mount"`
+		Ranges []clipRange `json:"ranges"`
+	}{str.Name, ranges})
+}
+
+// clip replies with an mp3 file of the frames that play between the
+// from and to times, in RFC 3339
+func (c *clips) clip(w http.ResponseWriter, r *http.Request) {
+	str, leave, ok := c.shifted(w, r)
+	if !ok {
+		return
+	}
+	defer leave()
+	q := r.URL.Query()
+	from, err := time.Parse(time.RFC3339, q.Get("from"))
+	if err != nil {
+		http.Error(w, "from must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	to, err := time.Parse(time.RFC3339, q.Get("to"))
+	if err != nil {
+		http.Error(w, "to must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > maxClip {
+		http.Error(w, fmt.Sprintf("clips can't be longer than %v", maxClip), http.StatusBadRequest)
+		return
+	}
+	cf, err := str.shift.clip(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer cf.Close()
+	if cf.size == 0 {
+		http.Error(w, "nothing kept in that range", http.StatusNotFound)
+		return
+	}
+	head := str.Codec.head
+	name := fmt.Sprintf("%s-%s.mp3", str.Name, from.UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", str.Codec.contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(head))+cf.size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if _, err := w.Write(head); err != nil {
+		return
+	}
+	cf.WriteTo(w)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// clipFrames builds the frames of a chunk, numbered from first on
+func clipFrames(first, n int) []byte {
+	var b []byte
+	for i := first; i < first+n; i++ {
+		var num [4]byte
+		binary.BigEndian.PutUint32(num[:], uint32(i))
+		b = append(b, mp3FrameBytes(false, num[:])...)
+	}
+	return b
+}
+
+// frameNumbers reads the numbers of frames back
+func frameNumbers(b []byte) []int {
+	var nums []int
+	for len(b) >= 417 {
+		nums = append(nums, int(binary.BigEndian.Uint32(b[36:])))
+		b = b[417:]
+	}
+	return nums
+}
+
+func TestClip(t *testing.T) {
+	ts, done := testShift(t, time.Hour)
+	defer done()
+	frameDur := decodeFrames(t, mp3FrameBytes(false, nil))[0].Duration()
+	// Chunks of 40 frames, a minute is 58 of them
+	for i := 0; i < 60; i++ {
+		ts.write(chunk{clipFrames(i*40, 40), 40 * frameDur})
+	}
+	if len(ts.segs) != 2 {
+		t.Fatalf("%d segments, want 2", len(ts.segs))
+	}
+	// Segments start when the one before ends in real time
+	seg1 := ts.segs[1]
+	seg1.at = ts.segs[0].at.Add(seg1.start)
+	// A record still being written isn't clipped
+	ts.file.Write([]byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1, 0, 0xff})
+
+	mounts := newMountList()
+	mounts.add(&streamer{Name: "stream", shift: ts, Codec: codecs["mp3"]})
+	c := &clips{mounts}
+	start := ts.segs[0].at
+	// at is when frame n starts playing
+	at := func(n float64) string {
+		return start.Add(time.Duration(n * float64(frameDur))).Format(time.RFC3339Nano)
+	}
+	tests := []struct {
+		name        string
+		from, to    float64
+		first, last int
+	}{
+		{"within a chunk", 5.5, 24.5, 5, 24},
+		{"across chunks", 35.5, 84.5, 35, 84},
+		{"whole chunks", 40, 120, 40, 119},
+		{"across segments", 2310, 2330.5, 2310, 2330},
+		{"to the end", 2390, 5000, 2390, 2399},
+		{"from before the start", -100, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		q := url.Values{"mount": {"stream"}, "from": {at(tt.from)}, "to": {at(tt.to)}}
+		w := httptest.NewRecorder()
+		c.clip(w, httptest.NewRequest(http.MethodGet, "/clip?"+q.Encode(), nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: %d %s", tt.name, w.Code, w.Body)
+			continue
+		}
+		body := w.Body.Bytes()
+		if n, err := strconv.Atoi(w.Header().Get("Content-Length")); err != nil || n != len(body) {
+			t.Errorf("%s: Content-Length %s, body of %d bytes", tt.name, w.Header().Get("Content-Length"), len(body))
+		}
+		head := codecs["mp3"].head
+		if string(body[:len(head)]) != string(head) || (len(body)-len(head))%417 != 0 {
+			t.Errorf("%s: %d bytes don't make a head and frames", tt.name, len(body))
+			continue
+		}
+		nums := frameNumbers(body[len(head):])
+		if len(nums) != tt.last-tt.first+1 || nums[0] != tt.first || nums[len(nums)-1] != tt.last {
+			t.Errorf("%s: %d frames from %v to %v, want %d to %d", tt.name, len(nums), nums[0], nums[len(nums)-1], tt.first, tt.last)
+			continue
+		}
+		for i, n := range nums {
+			if n != tt.first+i {
+				t.Errorf("%s: frame %d is %d", tt.name, i, n)
+				break
+			}
+		}
+	}
+
+	// Nothing kept then
+	q := url.Values{"from": {at(3000)}, "to": {at(4000)}}
+	w := httptest.NewRecorder()
+	c.clip(w, httptest.NewRequest(http.MethodGet, "/clip?"+q.Encode(), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("clip after the end: %d", w.Code)
+	}
+}
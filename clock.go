@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// What paces the stream
+const (
+	// Sleep so the frames go out in real time
+	clockOutput = "output"
+	// The input is real time already, send frames as they come
+	clockInput = "input"
+)
+
+// clockFlag is the -clock mode
+type clockFlag string
+
+func (c *clockFlag) String() string {
+	return string(*c)
+}
+
+func (c *clockFlag) Set(v string) error {
+	switch v {
+	case clockOutput, clockInput:
+		*c = clockFlag(v)
+		return nil
+	}
+	return fmt.Errorf("expected one of %s", strings.Join([]string{clockOutput, clockInput}, ", "))
+}
+
+// frameClock keeps the total duration of the frames sent since it started,
+// to be held against the monotonic clock. Pacing chunk by chunk adds up
+// rounding and sleep errors, the total doesn't
+type frameClock struct {
+	start time.Time
+	sent  time.Duration
+}
+
+// add counts dur more audio as sent and reports how far ahead of
+// real time the stream is, negative when it's behind. The first
+// chunk took its own duration to come in
+func (c *frameClock) add(dur time.Duration) time.Duration {
+	if c.start.IsZero() {
+		c.start = time.Now().Add(-dur)
+	}
+	c.sent += dur
+	return c.sent - time.Since(c.start)
+}
+
+// forgive moves the start up so the stream is behind by no more than max,
+// sending everything it's behind by at once would just be a burst.
+// It returns how much was forgiven
+func (c *frameClock) forgive(ahead, max time.Duration) time.Duration {
+	if ahead >= -max {
+		return 0
+	}
+	d := -ahead - max
+	c.start = c.start.Add(d)
+	return d
+}
+
+// pace waits for the real time of the chunk just sent. With the input
+// clock it doesn't wait and only measures the drift of the input, the
+// output clock counts how far behind the input left it as drift.
+// Silence for a stalled input is made up on the spot, so it goes by
+// the output clock either way and isn't drift of the input
+func (s *streamer) pace(clock *frameClock, dur time.Duration) {
+	ahead := clock.add(dur)
+	if s.Clock == clockInput && !s.stalled {
+		s.setDrift(ahead)
+		return
+	}
+	if d := clock.forgive(ahead, s.ReadSize); d > 0 {
+		if !s.stalled {
+			s.setDrift(s.getDrift() - d)
+		}
+		ahead += d
+	}
+	if ahead > 0 {
+		s.Lock()
+		s.count.sleeps++
+		s.count.slept += ahead.Seconds()
+		s.Unlock()
+		time.Sleep(ahead)
+	}
+}
+
+// setDrift records the drift, logging each second it moves
+func (s *streamer) setDrift(d time.Duration) {
+	s.Lock()
+	s.drift = d
+	s.Unlock()
+	if d-s.logDrift >= time.Second || s.logDrift-d >= time.Second {
+		s.logDrift = d
+		log.Printf("%s: clock drift %v\n", s.Name, d.Round(time.Millisecond))
+	}
+}
+
+// getDrift is how far ahead of real time the input has run,
+// negative when it's slow
+func (s *streamer) getDrift() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	return s.drift
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// near is how far timings in the tests may be off
+const near = 50 * time.Millisecond
+
+func within(d, want time.Duration) bool {
+	return d-want < near && want-d < near
+}
+
+func TestFrameClockForgive(t *testing.T) {
+	tests := []struct {
+		ahead, max time.Duration
+		forgiven   time.Duration
+	}{
+		{time.Second, time.Second, 0},
+		{0, time.Second, 0},
+		{-time.Second, time.Second, 0},
+		{-3 * time.Second, time.Second, 2 * time.Second},
+		{-500 * time.Millisecond, 0, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		c := frameClock{start: start}
+		if d := c.forgive(tt.ahead, tt.max); d != tt.forgiven || c.start.Sub(start) != tt.forgiven {
+			t.Errorf("forgive(%v, %v) = %v, start moved %v, want %v", tt.ahead, tt.max, d, c.start.Sub(start), tt.forgiven)
+		}
+	}
+}
+
+func TestFrameClockAdd(t *testing.T) {
+	var c frameClock
+	// The first chunk took its own time to come in
+	if ahead := c.add(time.Second); !within(ahead, 0) {
+		t.Errorf("first chunk %v ahead", ahead)
+	}
+	if ahead := c.add(time.Second); !within(ahead, time.Second) {
+		t.Errorf("second chunk %v ahead, want 1s", ahead)
+	}
+	c.start = c.start.Add(-3 * time.Second)
+	if ahead := c.add(0); !within(ahead, -2*time.Second) {
+		t.Errorf("%v ahead 3s later, want -2s", ahead)
+	}
+}
+
+func TestPace(t *testing.T) {
+	tests := []struct {
+		name    string
+		clock   clockFlag
+		stalled bool
+		// When the clock started and what it has counted so far
+		elapsed time.Duration
+		sent    time.Duration
+		// The drift recorded, the time slept
+		// and how far ahead the clock is after
+		drift time.Duration
+		slept time.Duration
+		ahead time.Duration
+	}{
+		{"output, behind more than ReadSize", clockOutput, false, 5 * time.Second, 0, -3900 * time.Millisecond, 0, -time.Second},
+		{"output, behind less than ReadSize", clockOutput, false, time.Second, 500 * time.Millisecond, 0, 0, -400 * time.Millisecond},
+		{"output, ahead", clockOutput, false, 0, 200 * time.Millisecond, 0, 300 * time.Millisecond, 0},
+		{"input, behind", clockInput, false, 5 * time.Second, 0, -4900 * time.Millisecond, 0, -4900 * time.Millisecond},
+		{"input, ahead", clockInput, false, 0, 200 * time.Millisecond, 300 * time.Millisecond, 0, 300 * time.Millisecond},
+		// Silence goes by the output clock and isn't drift
+		{"input stalled, behind", clockInput, true, 5 * time.Second, 0, 0, 0, -time.Second},
+		{"input stalled, ahead", clockInput, true, 0, 200 * time.Millisecond, 0, 300 * time.Millisecond, 0},
+	}
+	for _, tt := range tests {
+		s := &streamer{Name: "stream", Clock: tt.clock, ReadSize: time.Second, stalled: tt.stalled}
+		clock := &frameClock{start: time.Now().Add(-tt.elapsed), sent: tt.sent}
+		before := time.Now()
+		s.pace(clock, 100*time.Millisecond)
+		slept := time.Since(before)
+		if !within(s.getDrift(), tt.drift) {
+			t.Errorf("%s: drift %v, want %v", tt.name, s.getDrift(), tt.drift)
+		}
+		if !within(slept, tt.slept) || (tt.slept > 0) != (s.count.sleeps == 1) {
+			t.Errorf("%s: slept %v %d times, want %v", tt.name, slept, s.count.sleeps, tt.slept)
+		}
+		if ahead := clock.add(0); !within(ahead, tt.ahead) {
+			t.Errorf("%s: %v ahead after, want %v", tt.name, ahead, tt.ahead)
+		}
+	}
+}
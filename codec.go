@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strings"
+
+	"github.com/tcolgate/mp3"
+)
+
+// decoder splits an input into frames the streamer can pace and fan out
+type decoder interface {
+	next() (frame, error)
+}
+
+// codec is a stream format the streamer can carry
+type codec struct {
+	name        string
+	contentType string
+	// Extension of archive files
+	ext string
+	// head goes out to every client before anything else,
+	// unless the stream has headers of its own
+	head []byte
+	// A new head only goes to clients to come, not in the stream
+	// like a chained Ogg one, a WAV header in the data plays as noise
+	replaceHead bool
+	newDecoder  func(r io.Reader) decoder
+}
+
+// An empty ID3v2 tag, makes some players recognize the stream as mp3
+var emptyID3 = []byte{0x49, 0x44, 0x33, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+var codecs = map[string]*codec{
+	"mp3": {
+		name:        "mp3",
+		ext:         "mp3",
+		contentType: "audio/mpeg",
+		head:        emptyID3,
+		newDecoder: func(r io.Reader) decoder {
+			return newMP3Decoder(mp3.NewDecoder(r))
+		},
+	},
+	"aac": {
+		name:        "aac",
+		ext:         "aac",
+		contentType: "audio/aac",
+		newDecoder: func(r io.Reader) decoder {
+			return newADTSDecoder(r)
+		},
+	},
+	"ogg": {
+		name:        "ogg",
+		ext:         "ogg",
+		contentType: "audio/ogg",
+		newDecoder: func(r io.Reader) decoder {
+			return newOggDecoder(r)
+		},
+	},
+	"flac": {
+		name:        "flac",
+		ext:         "flac",
+		contentType: "audio/flac",
+		newDecoder: func(r io.Reader) decoder {
+			return newFLACDecoder(r)
+		},
+	},
+	// Replaced with the layout given by -rate, -channels and -bits
+	"pcm": newPCMCodec(pcmFormat{48000, 2, 16}),
+}
+
+// codecByType finds the codec for a source's Content-Type
+func codecByType(contentType string) (*codec, bool) {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	switch t {
+	case "audio/mpeg", "audio/mp3":
+		return codecs["mp3"], true
+	case "audio/aac", "audio/aacp", "audio/x-aac":
+		return codecs["aac"], true
+	case "audio/ogg", "application/ogg", "audio/opus", "audio/vorbis":
+		return codecs["ogg"], true
+	case "audio/flac", "audio/x-flac":
+		return codecs["flac"], true
+	}
+	return nil, false
+}
+
+// codecFlag is the -format flag
+type codecFlag struct {
+	*codec
+}
+
+func (c *codecFlag) String() string {
+	if c.codec == nil {
+		return ""
+	}
+	return c.name
+}
+
+func (c *codecFlag) Set(v string) error {
+	cd, ok := codecs[v]
+	if !ok {
+		var names []string
+		for name := range codecs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("expected one of %s", strings.Join(names, ", "))
+	}
+	c.codec = cd
+	return nil
+}
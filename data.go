@@ -2,87 +2,367 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tcolgate/mp3"
 )
 
+// frame is a frame as it goes out to clients, err is set on the
+// last one if decoding failed
+type frame struct {
+	data   []byte
+	dur    time.Duration
+	format audioFormat
+	// Bytes of garbage skipped before the frame
+	skipped int
+	// The mp3 header, nil for other codecs
+	header mp3.FrameHeader
+	// Stream headers new clients need first, for codecs that have them
+	head []byte
+	err  error
+}
+
+// chunk is a run of frames read at once, it starts at a frame boundary
+type chunk struct {
+	data []byte
+	dur  time.Duration
+}
+
 type streamer struct {
 	sync.RWMutex
-	clients   map[uint64]chan []byte
+	Name      string
+	clients   map[uint64]*session
 	id        uint64
-	buffer    []byte
+	buffer    []chunk
+	buffDur   time.Duration
+	head      []byte
 	BuffSize  time.Duration
 	ReadSize  time.Duration
 	QueueSize int
 	WriteBuff int
+	MetaInt   int
+	Stall     time.Duration
+	FmtChange formatFlag
+	Clock     clockFlag
+	ShiftKeep time.Duration
+	ShiftDir  string
+	Archive   archiveConfig
+	HLSTime   time.Duration
+	Auth      *listenAuth
 	Input     io.Reader
-	dec       *mp3.Decoder
-	frame     *mp3.Frame
-	skipped   *int
+	Open      func() (io.ReadCloser, error)
+	MaxRetry  time.Duration
+	Frames    frameReader
+	Codec     *codec
+	title     string
+	dec       decoder
+	input     io.Closer
+	backoff   time.Duration
+	frames    chan frame
+	last      mp3.FrameHeader
+	stalled   bool
+	silence   frame
+	format    audioFormat
+	dropped   int
+	cutting   bool
+	held      *frame
+	drift     time.Duration
+	shift     *timeShift
+	archive   *archive
+	hls       *hls
+	started   time.Time
+	peak      int
+	shifted   map[uint64]*session
+	sent      atomic.Uint64
+	bitrate   int
+	count     counters
+	logDrift  time.Duration
 	Stop      chan bool
 }
 
 func (s *streamer) init() (err error) {
-	s.Lock()
-	defer s.Unlock()
-	s.frame = new(mp3.Frame)
-	s.skipped = new(int)
-	s.clients = make(map[uint64]chan []byte)
-	s.dec = mp3.NewDecoder(s.Input)
-	s.buffer, _, err = s.readChunk(s.BuffSize)
+	switch {
+	case s.Frames != nil:
+		s.dec = newMP3Decoder(s.Frames)
+	case s.Open != nil:
+		s.reopen()
+	default:
+		s.dec = s.Codec.newDecoder(s.Input)
+	}
+	s.frames = make(chan frame)
 	s.Stop = make(chan bool)
-	if err != nil {
-		return
+	// decodeLoop stops along with the stream, or if it never starts
+	defer func() {
+		if err != nil {
+			close(s.Stop)
+		}
+	}()
+	go s.decodeLoop()
+	s.head = s.Codec.head
+	s.clients = make(map[uint64]*session)
+	s.shifted = make(map[uint64]*session)
+	s.started = time.Now()
+	if s.ShiftKeep > 0 {
+		s.shift, err = newTimeShift(filepath.Join(s.ShiftDir, s.Name), s.ShiftKeep)
+		if err != nil {
+			return err
+		}
+	}
+	if a := s.Archive; a.Dir != "" {
+		head := func() []byte {
+			s.RLock()
+			defer s.RUnlock()
+			return s.head
+		}
+		s.archive, err = newArchive(filepath.Join(a.Dir, s.Name), a.Name, s.Codec.ext, head, a.MaxAge, a.MaxSize)
+		if err != nil {
+			return err
+		}
 	}
-	log.Println("Buffer created...")
+	if s.HLSTime > 0 {
+		switch s.Codec.name {
+		case "mp3", "aac":
+			s.hls = newHLS(s.HLSTime, s.Codec.ext)
+		default:
+			log.Printf("%s: HLS is for mp3 and aac only\n", s.Name)
+		}
+	}
+	// The buffer is kept in chunks, so the oldest can be dropped
+	// without the burst starting in the middle of a frame
+	for s.buffDur < s.BuffSize {
+		buf, dur, err := s.readChunk(s.ReadSize)
+		if err != nil {
+			return err
+		}
+		s.addBurst(chunk{buf, dur})
+		s.record(chunk{buf, dur})
+		s.setBitrate(buf, dur)
+	}
+	log.Printf("%s: Buffer created...\n", s.Name)
 	return
 }
 
-func (s *streamer) addClient() (uint64, chan []byte) {
+// addBurst adds a chunk to the burst buffer, dropping the oldest
+// chunks that aren't needed to fill BuffSize
+func (s *streamer) addBurst(c chunk) {
+	s.Lock()
+	defer s.Unlock()
+	s.buffer = append(s.buffer, c)
+	s.buffDur += c.dur
+	for len(s.buffer) > 1 && s.buffDur-s.buffer[0].dur >= s.BuffSize {
+		s.buffDur -= s.buffer[0].dur
+		s.buffer = s.buffer[1:]
+	}
+}
+
+// record keeps a chunk for the time-shift, the archive and HLS, if they're on
+func (s *streamer) record(c chunk) {
+	if s.shift != nil {
+		s.shift.write(c)
+	}
+	if s.archive != nil {
+		s.archive.write(c.data, time.Now(), s.getTitle())
+	}
+	if s.hls != nil {
+		s.hls.add(c, s.getTitle())
+	}
+}
+
+// newID numbers a listener, time-shifted ones too
+func (s *streamer) newID() uint64 {
 	s.Lock()
 	defer s.Unlock()
 	s.id++
-	s.clients[s.id] = make(chan []byte, s.QueueSize)
-	return s.id, s.clients[s.id]
+	return s.id
+}
+
+func (s *streamer) addClient(w http.ResponseWriter, r *http.Request, id uint64) *session {
+	s.Lock()
+	defer s.Unlock()
+	c := newSession(w, r, s.QueueSize)
+	s.clients[id] = c
+	s.count.connections++
+	s.updatePeak()
+	return c
 }
 
 func (s *streamer) delClient(id uint64) {
 	s.Lock()
 	defer s.Unlock()
-	close(s.clients[id])
-	delete(s.clients, id)
+	// Clients that got cut or killed are gone already
+	if c, ok := s.clients[id]; ok {
+		close(c.ch)
+		delete(s.clients, id)
+	}
+}
+
+func (s *streamer) setTitle(title string) {
+	s.Lock()
+	defer s.Unlock()
+	s.title = title
+}
+
+func (s *streamer) getTitle() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.title
+}
+
+// listeners is how many clients are connected, time-shifted ones included
+func (s *streamer) listeners() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.clients) + len(s.shifted)
 }
 
 func (s *streamer) send(b []byte) {
 	s.RLock()
 	defer s.RUnlock()
-	for _, v := range s.clients {
+	for _, c := range s.clients {
 		select {
-		case v <- b:
+		case c.ch <- b:
 		default:
+			c.dropped.Add(1)
+			s.count.dropChunks.Add(1)
 		}
 	}
 }
 
-func (s *streamer) readChunk(expd time.Duration) (buf []byte, reald time.Duration, err error) {
+// decodeLoop decodes the input on its own so a stalled input
+// doesn't hold up the read loop. Inputs that can be opened again
+// are reopened on errors, clients just hear nothing meanwhile
+func (s *streamer) decodeLoop() {
 	for {
-		err = s.dec.Decode(s.frame, s.skipped)
-		if err != nil {
+		f, err := s.dec.next()
+		if err == nil {
+			s.backoff = 0
+			select {
+			case s.frames <- f:
+			case <-s.Stop:
+				return
+			}
+			continue
+		}
+		if s.Open == nil {
+			select {
+			case s.frames <- frame{err: err}:
+			case <-s.Stop:
+			}
 			return
 		}
-		var tmp []byte
-		tmp, err = ioutil.ReadAll(s.frame.Reader())
+		log.Printf("%s: input: %v\n", s.Name, err)
+		s.reopen()
+	}
+}
+
+// nextFrame returns the next input frame, or silence once the input
+// has been quiet for longer than Stall
+func (s *streamer) nextFrame() frame {
+	if s.Stall <= 0 || s.last == nil {
+		return s.received(<-s.frames)
+	}
+	if s.stalled {
+		select {
+		case f := <-s.frames:
+			log.Printf("%s: input resumed\n", s.Name)
+			return s.received(f)
+		default:
+			return s.silentFrame()
+		}
+	}
+	timer := time.NewTimer(s.Stall)
+	defer timer.Stop()
+	select {
+	case f := <-s.frames:
+		return s.received(f)
+	case <-timer.C:
+		log.Printf("%s: input stalled, sending silence\n", s.Name)
+		return s.silentFrame()
+	}
+}
+
+func (s *streamer) received(f frame) frame {
+	s.Lock()
+	s.stalled = false
+	if f.err == nil {
+		s.count.decoded++
+		s.count.skipped += uint64(f.skipped)
+	}
+	s.Unlock()
+	return f
+}
+
+// silentFrame returns a silent frame in the format of the last frame sent
+func (s *streamer) silentFrame() frame {
+	s.Lock()
+	s.stalled = true
+	s.Unlock()
+	if s.silence.header == nil || !sameFormat(s.silence.header, s.last) {
+		f, err := makeSilence(s.last)
 		if err != nil {
+			return frame{err: err}
+		}
+		s.silence = f
+	}
+	return s.silence
+}
+
+// sameFormat compares the version, layer, bitrate, sample rate and channel mode
+func sameFormat(a, b mp3.FrameHeader) bool {
+	return a[1]&0xfe == b[1]&0xfe && a[2]&0xfc == b[2]&0xfc && a[3]&0xc0 == b[3]&0xc0
+}
+
+func (s *streamer) readChunk(expd time.Duration) (buf []byte, reald time.Duration, err error) {
+	var cut bool
+	for {
+		var f frame
+		if s.held != nil {
+			f, s.held = *s.held, nil
+		} else {
+			f = s.nextFrame()
+		}
+		if f.err != nil {
+			err = f.err
 			return
 		}
-		buf = append(buf, tmp...)
-		reald += s.frame.Duration()
+		if !s.checkFormat(f) {
+			continue
+		}
+		// Silence goes out in the format frames are let through in
+		if f.header != nil {
+			s.last = f.header
+		}
+		// The chunk so far goes out in the old format, the cut comes after it
+		if s.cutting {
+			if len(buf) > 0 {
+				s.held = &f
+				return
+			}
+			s.cutClients()
+			s.cutting = false
+			cut = true
+		}
+		if f.head != nil && !bytes.Equal(f.head, s.head) {
+			// A chained stream with new headers, who's listening
+			// already gets them in the stream
+			if !cut && s.head != nil && !s.Codec.replaceHead {
+				buf = append(buf, f.head...)
+			}
+			s.Lock()
+			s.head = f.head
+			s.Unlock()
+		}
+		buf = append(buf, f.data...)
+		reald += f.dur
 		if expd < reald {
 			return
 		}
@@ -91,60 +371,101 @@ func (s *streamer) readChunk(expd time.Duration) (buf []byte, reald time.Duratio
 
 func (s *streamer) readLoop() {
 	defer close(s.Stop)
-	var wait time.Duration
-	var start time.Time
+	var clock frameClock
 	for {
-		start = time.Now()
 		buf, dur, err := s.readChunk(s.ReadSize)
 		if err != nil {
-			log.Println(err)
+			log.Printf("%s: %v\n", s.Name, err)
 			return
 		}
 		s.send(buf)
-		s.Lock()
-		if len(s.buffer) < len(buf) {
-			s.buffer = buf
-		} else {
-			s.buffer = append(s.buffer[len(buf):], buf...)
-		}
-		s.Unlock()
-		wait += dur - time.Now().Sub(start)
-		if wait > dur {
-			time.Sleep(wait)
-			wait = 0
-		}
+		s.addBurst(chunk{buf, dur})
+		s.record(chunk{buf, dur})
+		s.setBitrate(buf, dur)
+		s.pace(&clock, dur)
 	}
 }
 
 func (s *streamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	id, recieve := s.addClient()
-	defer s.delClient(id)
+	// Listeners can start back in time, as far as the burst goes
+	// it's just a live listener
+	var offset time.Duration
+	if v := r.URL.Query().Get("offset"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec > 0 {
+			http.Error(w, "offset must be negative seconds", http.StatusBadRequest)
+			return
+		}
+		if s.shift == nil {
+			http.Error(w, "time-shift is disabled", http.StatusNotFound)
+			return
+		}
+		offset = time.Duration(sec) * time.Second
+		if -offset <= s.BuffSize {
+			offset = 0
+		}
+	}
+	id := s.newID()
+	leave, ok := s.admit(w, r, id)
+	if !ok {
+		return
+	}
+	defer leave()
 
 	// Set some headers
-	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("Content-Type", s.Codec.contentType)
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Server", "dumb-mp3-streamer")
-	//Send MP3 stream header
-	head := []byte{0x49, 0x44, 0x33, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	f := s.getFormat()
+	w.Header().Set("ice-audio-info", fmt.Sprintf("samplerate=%d;channels=%d", f.SampleRate, f.Channels))
 	//Send data in chunks
-	buffw := bufio.NewWriterSize(w, s.WriteBuff)
-	if _, err := buffw.Write(head); err != nil {
+	sw := &sentWriter{w: w, s: s}
+	buffw := bufio.NewWriterSize(sw, s.WriteBuff)
+	var out io.Writer = buffw
+	//Interleave metadata if the client asks for it
+	if r.Header.Get("Icy-MetaData") == "1" {
+		w.Header().Set("icy-metaint", strconv.Itoa(s.MetaInt))
+		out = newIcyWriter(buffw, s)
+	}
+	if offset < 0 {
+		c := newSession(w, r, 0)
+		c.offset = offset
+		sw.c = c
+		s.playShift(r, id, c, buffw, out)
 		return
 	}
-	//Copy buffer
+	c := s.addClient(w, r, id)
+	defer s.delClient(id)
+	sw.c = c
+	recieve := c.ch
+	//Copy the stream header and the buffer, chunks don't change once read
 	s.RLock()
-	buf := make([]byte, len(s.buffer))
-	copy(buf, s.buffer)
+	head := s.head
+	burst := make([]chunk, len(s.buffer))
+	copy(burst, s.buffer)
 	s.RUnlock()
-	if _, err := buffw.Write(buf); err != nil {
+	if _, err := out.Write(head); err != nil {
 		return
 	}
-	buf = nil
+	for _, c := range burst {
+		if _, err := out.Write(c.data); err != nil {
+			return
+		}
+	}
+	burst = nil
 
 	for {
-		chunk := <-recieve
-		if _, err := buffw.Write(chunk); err != nil {
+		select {
+		case chunk, ok := <-recieve:
+			if !ok {
+				buffw.Flush()
+				return
+			}
+			if _, err := out.Write(chunk); err != nil {
+				return
+			}
+		case <-s.Stop:
 			return
 		}
 	}
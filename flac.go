@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var flacCRC8Table = func() (t [256]byte) {
+	for i := range t {
+		r := byte(i)
+		for j := 0; j < 8; j++ {
+			if r&0x80 != 0 {
+				r = r<<1 ^ 0x07
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return
+}()
+
+var flacCRC16Table = func() (t [256]uint16) {
+	for i := range t {
+		r := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if r&0x8000 != 0 {
+				r = r<<1 ^ 0x8005
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return
+}()
+
+var flacSampleRates = [...]int{
+	0, 88200, 176400, 192000, 8000, 16000, 22050, 24000, 32000, 44100, 48000, 96000,
+}
+
+const flacStreamInfoLen = 34
+
+// flacStreamInfo is the STREAMINFO metadata block
+type flacStreamInfo []byte
+
+func (si flacStreamInfo) sampleRate() int {
+	return int(si[10])<<12 | int(si[11])<<4 | int(si[12])>>4
+}
+
+func (si flacStreamInfo) channels() int {
+	return int(si[12]>>1&0x07) + 1
+}
+
+// flacHead is what a client needs before any frame: the stream marker and
+// STREAMINFO as the only metadata block. The length and checksum of the
+// whole stream are unknown when it's live, so they're zeroed out
+func flacHead(si flacStreamInfo) []byte {
+	head := make([]byte, 0, 8+flacStreamInfoLen)
+	head = append(head, "fLaC"...)
+	head = append(head, 0x80, 0, 0, flacStreamInfoLen)
+	head = append(head, si...)
+	b := head[8:]
+	b[13] &= 0xf0
+	for i := 14; i < flacStreamInfoLen; i++ {
+		b[i] = 0
+	}
+	return head
+}
+
+// flacFrameHeader is a parsed FLAC frame header
+type flacFrameHeader struct {
+	blockSize  int
+	sampleRate int
+	channels   int
+}
+
+// parseFLACHeader parses the frame header at the start of b. It reports the
+// header length, 0 if b doesn't start with a valid header and -1 if b is
+// too short to tell
+func parseFLACHeader(b []byte, si flacStreamInfo) (h flacFrameHeader, n int) {
+	if len(b) < 4 {
+		return h, -1
+	}
+	if b[0] != 0xff || b[1]&0xfe != 0xf8 || b[3]&0x01 != 0 {
+		return
+	}
+	bs, sr, ch := b[2]>>4, b[2]&0x0f, b[3]>>4
+	if bs == 0 || sr == 15 || ch > 10 || b[3]>>1&0x07 == 3 || b[3]>>1&0x07 == 7 {
+		return
+	}
+	// The coded frame or sample number, UTF-8 style
+	n = 4
+	if len(b) < n+1 {
+		return h, -1
+	}
+	extra := 0
+	for c := b[n]; c&0x80 != 0; c <<= 1 {
+		extra++
+	}
+	switch {
+	case extra == 1 || extra > 7:
+		return h, 0
+	case extra > 1:
+		extra--
+	}
+	n += 1 + extra
+	switch {
+	case bs == 1:
+		h.blockSize = 192
+	case bs <= 5:
+		h.blockSize = 576 << (bs - 2)
+	case bs == 6:
+		n++
+		if len(b) < n {
+			return h, -1
+		}
+		h.blockSize = int(b[n-1]) + 1
+	case bs == 7:
+		n += 2
+		if len(b) < n {
+			return h, -1
+		}
+		h.blockSize = int(b[n-2])<<8 | int(b[n-1]) + 1
+	default:
+		h.blockSize = 256 << (bs - 8)
+	}
+	switch {
+	case sr == 0:
+		if si != nil {
+			h.sampleRate = si.sampleRate()
+		}
+	case sr < 12:
+		h.sampleRate = flacSampleRates[sr]
+	case sr == 12:
+		n++
+		if len(b) < n {
+			return h, -1
+		}
+		h.sampleRate = int(b[n-1]) * 1000
+	default:
+		n += 2
+		if len(b) < n {
+			return h, -1
+		}
+		h.sampleRate = int(b[n-2])<<8 | int(b[n-1])
+		if sr == 14 {
+			h.sampleRate *= 10
+		}
+	}
+	if len(b) < n+1 {
+		return h, -1
+	}
+	var crc byte
+	for _, c := range b[:n] {
+		crc = flacCRC8Table[crc^c]
+	}
+	if crc != b[n] || h.sampleRate == 0 {
+		return h, 0
+	}
+	h.channels = int(ch) + 1
+	if ch > 7 {
+		h.channels = 2
+	}
+	return h, n + 1
+}
+
+// flacDecoder splits a native FLAC stream into frames. Frames don't say how
+// long they are, so a frame ends where the next valid header starts and
+// the checksum of everything up to it adds up. Concatenated files are fine,
+// each "fLaC" marker starts over with its STREAMINFO
+type flacDecoder struct {
+	r    io.Reader
+	buf  []byte
+	eof  bool
+	info flacStreamInfo
+	head []byte
+}
+
+func newFLACDecoder(r io.Reader) *flacDecoder {
+	return &flacDecoder{
+		r: r,
+	}
+}
+
+// fill reads more of the input into the buffer
+func (d *flacDecoder) fill() error {
+	if d.eof {
+		return io.EOF
+	}
+	if cap(d.buf)-len(d.buf) < 4096 {
+		buf := make([]byte, len(d.buf), 2*cap(d.buf)+8192)
+		copy(buf, d.buf)
+		d.buf = buf
+	}
+	n, err := d.r.Read(d.buf[len(d.buf):cap(d.buf)])
+	d.buf = d.buf[:len(d.buf)+n]
+	if err == io.EOF {
+		d.eof = true
+		if n > 0 {
+			err = nil
+		}
+	}
+	return err
+}
+
+// need makes sure n bytes are buffered
+func (d *flacDecoder) need(n int) error {
+	for len(d.buf) < n {
+		if err := d.fill(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *flacDecoder) discard(n int) {
+	d.buf = d.buf[:copy(d.buf, d.buf[n:])]
+}
+
+// readMetadata reads the metadata blocks after a "fLaC" marker
+func (d *flacDecoder) readMetadata() error {
+	pos := 4
+	var info flacStreamInfo
+	for last := false; !last; {
+		if err := d.need(pos + 4); err != nil {
+			return err
+		}
+		bh := d.buf[pos : pos+4]
+		last = bh[0]&0x80 != 0
+		typ := bh[0] & 0x7f
+		size := int(bh[1])<<16 | int(bh[2])<<8 | int(bh[3])
+		pos += 4
+		if err := d.need(pos + size); err != nil {
+			return err
+		}
+		if typ == 0 && size == flacStreamInfoLen {
+			info = append(flacStreamInfo(nil), d.buf[pos:pos+size]...)
+		}
+		pos += size
+	}
+	d.discard(pos)
+	if info == nil {
+		return errors.New("flac: no STREAMINFO")
+	}
+	d.info = info
+	d.head = flacHead(info)
+	return nil
+}
+
+func (d *flacDecoder) next() (frame, error) {
+	var skipped int
+	for {
+		if err := d.need(4); err != nil {
+			if err == io.ErrUnexpectedEOF && len(d.buf) == 0 {
+				err = io.EOF
+			}
+			return frame{}, err
+		}
+		if string(d.buf[:4]) == "fLaC" {
+			if err := d.readMetadata(); err != nil {
+				return frame{}, err
+			}
+			continue
+		}
+		h, n := parseFLACHeader(d.buf, d.info)
+		if n < 0 {
+			if err := d.fill(); err != nil {
+				return frame{}, err
+			}
+			continue
+		}
+		if n == 0 || d.info == nil {
+			d.discard(1)
+			skipped++
+			continue
+		}
+		size, err := d.frameEnd(n)
+		if err != nil {
+			return frame{}, err
+		}
+		data := append([]byte(nil), d.buf[:size]...)
+		d.discard(size)
+		return frame{
+			data: data,
+			dur:  time.Duration(h.blockSize) * time.Second / time.Duration(h.sampleRate),
+			format: audioFormat{
+				Codec:      "FLAC",
+				SampleRate: h.sampleRate,
+				Channels:   h.channels,
+			},
+			head:    d.head,
+			skipped: skipped,
+		}, nil
+	}
+}
+
+// frameEnd finds the length of the frame at the start of the buffer,
+// whose header is n bytes long
+func (d *flacDecoder) frameEnd(n int) (int, error) {
+	var crc uint16
+	for _, c := range d.buf[:n] {
+		crc = crc<<8 ^ flacCRC16Table[byte(crc>>8)^c]
+	}
+	for pos := n; ; pos++ {
+		for pos+16 > len(d.buf) {
+			if err := d.fill(); err != nil {
+				if err != io.EOF {
+					return 0, err
+				}
+				if pos >= len(d.buf) {
+					// The last frame of the stream
+					return len(d.buf), nil
+				}
+				break
+			}
+		}
+		// A checksum over the frame including its own footer comes out as 0
+		if crc == 0 && pos > n+2 {
+			if bytes.HasPrefix(d.buf[pos:], []byte("fLaC")) {
+				return pos, nil
+			}
+			if _, m := parseFLACHeader(d.buf[pos:], d.info); m > 0 {
+				return pos, nil
+			}
+		}
+		crc = crc<<8 ^ flacCRC16Table[byte(crc>>8)^d.buf[pos]]
+	}
+}
+
+// oggFLACStream starts an Ogg FLAC stream from its first packet: the
+// mapping header, the "fLaC" marker and STREAMINFO
+func oggFLACStream(st *oggStream, id []byte) bool {
+	if len(id) < 17+flacStreamInfoLen || string(id[9:13]) != "fLaC" {
+		return false
+	}
+	si := flacStreamInfo(id[17 : 17+flacStreamInfoLen])
+	st.rate = si.sampleRate()
+	// The first packet and the other metadata blocks, at least a comment
+	st.needed = 1 + int(binary.BigEndian.Uint16(id[7:9]))
+	if st.needed == 1 {
+		st.needed = 2
+	}
+	st.format = audioFormat{
+		Codec:      "FLAC",
+		SampleRate: st.rate,
+		Channels:   si.channels(),
+	}
+	return true
+}
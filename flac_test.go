@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// flacInfo builds a STREAMINFO block
+func flacInfo(rate, channels, bits int) flacStreamInfo {
+	si := make(flacStreamInfo, flacStreamInfoLen)
+	binary.BigEndian.PutUint16(si[0:], 4096)
+	binary.BigEndian.PutUint16(si[2:], 4096)
+	si[10] = byte(rate >> 12)
+	si[11] = byte(rate >> 4)
+	si[12] = byte(rate&0x0f)<<4 | byte(channels-1)<<1 | byte(bits-1)>>4
+	si[13] = byte(bits-1)<<4 | 0x01
+	for i := 14; i < flacStreamInfoLen; i++ {
+		si[i] = byte(i)
+	}
+	return si
+}
+
+// flacHeaderBytes appends the CRC-8 to a frame header
+func flacHeaderBytes(b ...byte) []byte {
+	var crc byte
+	for _, c := range b {
+		crc = flacCRC8Table[crc^c]
+	}
+	return append(b, crc)
+}
+
+// flacFrame builds a frame of a header, a body and the CRC-16 footer
+func flacFrame(header, body []byte) []byte {
+	f := append(append([]byte(nil), header...), body...)
+	var crc uint16
+	for _, c := range f {
+		crc = crc<<8 ^ flacCRC16Table[byte(crc>>8)^c]
+	}
+	return append(f, byte(crc>>8), byte(crc))
+}
+
+func TestParseFLACHeader(t *testing.T) {
+	si := flacInfo(44100, 2, 16)
+	bad := flacHeaderBytes(0xff, 0xf8, 0xc9, 0x18, 0x00)
+	bad[len(bad)-1]++
+	tests := []struct {
+		name  string
+		b     []byte
+		si    flacStreamInfo
+		n     int
+		block int
+		rate  int
+		chans int
+	}{
+		{"4096 at 44.1k stereo", flacHeaderBytes(0xff, 0xf8, 0xc9, 0x18, 0x00), nil, 6, 4096, 44100, 2},
+		{"variable blocksize", flacHeaderBytes(0xff, 0xf9, 0x1a, 0x08, 0x05), nil, 6, 192, 48000, 1},
+		{"8 bit blocksize, kHz rate", flacHeaderBytes(0xff, 0xf8, 0x6c, 0x00, 0x00, 99, 22), nil, 8, 100, 22000, 1},
+		{"16 bit blocksize, Hz rate", flacHeaderBytes(0xff, 0xf8, 0x7d, 0x50, 0x00, 0x03, 0xff, 0x1f, 0x40), nil, 10, 1024, 8000, 6},
+		{"tens of Hz rate", flacHeaderBytes(0xff, 0xf8, 0x3e, 0x80, 0x00, 0x11, 0x3a), nil, 8, 1152, 44100, 2},
+		{"rate from STREAMINFO", flacHeaderBytes(0xff, 0xf8, 0xc0, 0x98, 0x00), si, 6, 4096, 44100, 2},
+		{"rate from missing STREAMINFO", flacHeaderBytes(0xff, 0xf8, 0xc0, 0x18, 0x00), nil, 0, 0, 0, 0},
+		{"two byte frame number", flacHeaderBytes(0xff, 0xf8, 0xc9, 0xa8, 0xc2, 0x80), nil, 7, 4096, 44100, 2},
+		{"seven byte frame number", flacHeaderBytes(0xff, 0xf9, 0xc9, 0x18, 0xfe, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80), nil, 12, 4096, 44100, 2},
+		{"continuation byte first", flacHeaderBytes(0xff, 0xf8, 0xc9, 0x18, 0x80), nil, 0, 0, 0, 0},
+		{"bad CRC-8", bad, nil, 0, 0, 0, 0},
+		{"reserved blocksize", flacHeaderBytes(0xff, 0xf8, 0x09, 0x18, 0x00), nil, 0, 0, 0, 0},
+		{"invalid rate", flacHeaderBytes(0xff, 0xf8, 0xcf, 0x18, 0x00), nil, 0, 0, 0, 0},
+		{"reserved channels", flacHeaderBytes(0xff, 0xf8, 0xc9, 0xb8, 0x00), nil, 0, 0, 0, 0},
+		{"reserved sample size", flacHeaderBytes(0xff, 0xf8, 0xc9, 0x16, 0x00), nil, 0, 0, 0, 0},
+		{"reserved bit", flacHeaderBytes(0xff, 0xf8, 0xc9, 0x19, 0x00), nil, 0, 0, 0, 0},
+		{"mp3 sync", []byte{0xff, 0xfb, 0x90, 0x00, 0x00}, nil, 0, 0, 0, 0},
+		{"too short", []byte{0xff, 0xf8, 0xc9}, nil, -1, 0, 0, 0},
+		{"too short for the CRC", []byte{0xff, 0xf8, 0xc9, 0x18, 0x00}, nil, -1, 0, 0, 0},
+		{"too short for the rate", []byte{0xff, 0xf8, 0x6c, 0x00, 0x00, 99}, nil, -1, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		h, n := parseFLACHeader(tt.b, tt.si)
+		if n != tt.n {
+			t.Errorf("%s: n %d, want %d", tt.name, n, tt.n)
+			continue
+		}
+		if n > 0 && (h.blockSize != tt.block || h.sampleRate != tt.rate || h.channels != tt.chans) {
+			t.Errorf("%s: %d samples at %d Hz, %d channels, want %d at %d Hz, %d channels", tt.name,
+				h.blockSize, h.sampleRate, h.channels, tt.block, tt.rate, tt.chans)
+		}
+	}
+}
+
+func TestFLACHead(t *testing.T) {
+	si := flacInfo(48000, 2, 24)
+	head := flacHead(si)
+	if string(head[:4]) != "fLaC" || head[4] != 0x80 || int(head[7]) != flacStreamInfoLen {
+		t.Errorf("head starts % x", head[:8])
+	}
+	got := flacStreamInfo(head[8:])
+	if got.sampleRate() != 48000 || got.channels() != 2 {
+		t.Errorf("%d Hz, %d channels", got.sampleRate(), got.channels())
+	}
+	if got[13]&0x0f != 0 || !bytes.Equal(got[14:], make([]byte, flacStreamInfoLen-14)) {
+		t.Error("total samples and MD5 aren't zeroed")
+	}
+	if !bytes.Equal(si, flacInfo(48000, 2, 24)) {
+		t.Error("flacHead changed the STREAMINFO it was given")
+	}
+}
+
+func TestFLACDecoder(t *testing.T) {
+	si := flacInfo(44100, 2, 16)
+	header := flacHeaderBytes(0xff, 0xf8, 0xc9, 0x18, 0x00)
+	// A body with what looks like a frame header in it
+	body1 := append(bytes.Repeat([]byte{0x11}, 100), header...)
+	body1 = append(body1, bytes.Repeat([]byte{0x22}, 100)...)
+	frame1 := flacFrame(header, body1)
+	frame2 := flacFrame(flacHeaderBytes(0xff, 0xf8, 0xc9, 0x18, 0x01), bytes.Repeat([]byte{0x33}, 50))
+	// The rate of the next stream comes from its STREAMINFO
+	si2 := flacInfo(48000, 1, 16)
+	frame3 := flacFrame(flacHeaderBytes(0xff, 0xf8, 0xc0, 0x08, 0x00), bytes.Repeat([]byte{0x44}, 10))
+
+	// Frames end where the next one starts, so garbage
+	// can only be skipped before the stream marker
+	var in bytes.Buffer
+	in.WriteString("xyz")
+	in.WriteString("fLaC")
+	// A padding block, then STREAMINFO as the last
+	in.Write([]byte{0x01, 0, 0, 3, 0, 0, 0})
+	in.Write([]byte{0x80, 0, 0, flacStreamInfoLen})
+	in.Write(si)
+	in.Write(frame1)
+	in.Write(frame2)
+	// A chained stream
+	in.WriteString("fLaC")
+	in.Write([]byte{0x80, 0, 0, flacStreamInfoLen})
+	in.Write(si2)
+	in.Write(frame3)
+
+	d := newFLACDecoder(&in)
+	want := []struct {
+		data    []byte
+		skipped int
+		si      flacStreamInfo
+	}{
+		{frame1, 3, si},
+		{frame2, 0, si},
+		{frame3, 0, si2},
+	}
+	for i, w := range want {
+		f, err := d.next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(f.data, w.data) || f.skipped != w.skipped {
+			t.Errorf("frame %d: %d bytes after skipping %d, want %d after %d", i,
+				len(f.data), f.skipped, len(w.data), w.skipped)
+		}
+		rate := w.si.sampleRate()
+		if f.dur != 4096*time.Second/time.Duration(rate) || f.format.SampleRate != rate || f.format.Channels != w.si.channels() {
+			t.Errorf("frame %d: %v, %v", i, f.dur, f.format)
+		}
+		if !bytes.Equal(f.head, flacHead(w.si)) {
+			t.Errorf("frame %d: head % x", i, f.head)
+		}
+	}
+	if _, err := d.next(); err != io.EOF {
+		t.Errorf("err %v at the end, want %v", err, io.EOF)
+	}
+}
+
+func TestFLACDecoderNoStreamInfo(t *testing.T) {
+	in := append([]byte("fLaC"), 0x81, 0, 0, 2, 0, 0)
+	if _, err := newFLACDecoder(bytes.NewReader(in)).next(); err == nil {
+		t.Error("no error without STREAMINFO")
+	}
+}
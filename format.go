@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// audioFormat is what has to stay the same for frames to play back to back
+type audioFormat struct {
+	Codec      string
+	SampleRate int
+	Channels   int
+}
+
+func (f audioFormat) String() string {
+	channels := fmt.Sprintf("%d channels", f.Channels)
+	switch f.Channels {
+	case 1:
+		channels = "mono"
+	case 2:
+		channels = "stereo"
+	}
+	return fmt.Sprintf("%s %dHz %s", f.Codec, f.SampleRate, channels)
+}
+
+// What to do when the input changes format mid stream
+const (
+	// Pass the new format on as is
+	formatKeep = "keep"
+	// Drop frames that don't match the first format seen
+	formatDrop = "drop"
+	// Disconnect clients so their players start over with the new format
+	formatCut = "cut"
+)
+
+// formatFlag is the -formatchange policy
+type formatFlag string
+
+func (f *formatFlag) String() string {
+	return string(*f)
+}
+
+func (f *formatFlag) Set(v string) error {
+	switch v {
+	case formatKeep, formatDrop, formatCut:
+		*f = formatFlag(v)
+		return nil
+	}
+	return fmt.Errorf("expected one of %s", strings.Join([]string{formatKeep, formatDrop, formatCut}, ", "))
+}
+
+func (s *streamer) getFormat() audioFormat {
+	s.RLock()
+	defer s.RUnlock()
+	return s.format
+}
+
+// checkFormat applies the format change policy to a frame,
+// returning false if the frame must not be sent
+func (s *streamer) checkFormat(f frame) bool {
+	fmtf := f.format
+	s.RLock()
+	cur := s.format
+	s.RUnlock()
+	switch {
+	case cur == fmtf:
+		if s.dropped > 0 {
+			log.Printf("%s: format is back to %v, dropped %d frames\n", s.Name, cur, s.dropped)
+			s.dropped = 0
+		}
+		return true
+	case cur == audioFormat{}:
+		log.Printf("%s: format %v\n", s.Name, fmtf)
+	case s.FmtChange == formatDrop:
+		if s.dropped == 0 {
+			log.Printf("%s: format changed to %v, dropping frames\n", s.Name, fmtf)
+		}
+		s.dropped++
+		return false
+	case s.FmtChange == formatCut:
+		log.Printf("%s: format changed from %v to %v, cutting clients over\n", s.Name, cur, fmtf)
+		s.cutting = true
+	default:
+		log.Printf("%s: format changed from %v to %v\n", s.Name, cur, fmtf)
+	}
+	s.Lock()
+	s.format = fmtf
+	s.Unlock()
+	return true
+}
+
+// cutClients ends every client's stream once it got what was queued
+// and empties the burst buffer, so nothing mixes the old and the new format
+func (s *streamer) cutClients() {
+	s.Lock()
+	defer s.Unlock()
+	for id, c := range s.clients {
+		close(c.ch)
+		delete(s.clients, id)
+	}
+	s.buffer = nil
+	s.buffDur = 0
+}
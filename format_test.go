@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// An input that changes format and stalls gets silence in the format
+// frames are let through in, not in the one being dropped
+func TestFormatDropStall(t *testing.T) {
+	raw := decodeFrames(t, mp3FrameBytes(false, nil), mp3FrameBytes(true, nil))
+	stereo, mono := newMP3Frame(raw[0]), newMP3Frame(raw[1])
+	s := &streamer{
+		Name:      "stream",
+		Stall:     10 * time.Millisecond,
+		FmtChange: formatDrop,
+		frames:    make(chan frame, 2),
+	}
+	s.frames <- stereo
+	s.frames <- mono
+
+	type result struct {
+		buf []byte
+		dur time.Duration
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		buf, dur, err := s.readChunk(100 * time.Millisecond)
+		done <- result{buf, dur, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("readChunk didn't return")
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if s.getFormat() != stereo.format {
+		t.Errorf("format %v, want %v", s.getFormat(), stereo.format)
+	}
+	size := len(stereo.data)
+	if len(r.buf) != 4*size || r.dur != 4*stereo.dur {
+		t.Fatalf("%d bytes of %v, want %d of %v", len(r.buf), r.dur, 4*size, 4*stereo.dur)
+	}
+	for i := 0; i < len(r.buf); i += size {
+		if f := mp3Format(r.buf[i : i+4]); f != stereo.format {
+			t.Errorf("frame %d: %v", i/size, f)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Segments in the live playlist
+const hlsWindow = 6
+
+// hlsSegment is a run of whole chunks, led by an ID3 tag
+type hlsSegment struct {
+	seq  int
+	dur  time.Duration
+	data []byte
+}
+
+// hls cuts the stream into segments of packed audio for HTTP Live
+// Streaming and keeps the last few of them for the playlist
+type hls struct {
+	sync.RWMutex
+	target time.Duration
+	ext    string
+	segs   []hlsSegment
+	seq    int
+	// Stream time at the start of the segment being put together
+	pts   time.Duration
+	cur   []byte
+	dur   time.Duration
+	title string
+}
+
+func newHLS(target time.Duration, ext string) *hls {
+	return &hls{
+		target: target,
+		ext:    ext,
+	}
+}
+
+// add adds a chunk, finishing the segment once it's long enough
+func (h *hls) add(c chunk, title string) {
+	if h.cur == nil {
+		// The segment gets the title playing at its start
+		h.title = title
+	}
+	h.cur = append(h.cur, c.data...)
+	h.dur += c.dur
+	if h.dur < h.target {
+		return
+	}
+	seg := hlsSegment{
+		dur:  h.dur,
+		data: append(hlsID3(h.pts, h.title), h.cur...),
+	}
+	h.pts += h.dur
+	h.cur = nil
+	h.dur = 0
+	h.Lock()
+	seg.seq = h.seq
+	h.seq++
+	h.segs = append(h.segs, seg)
+	if len(h.segs) > hlsWindow {
+		h.segs = h.segs[1:]
+	}
+	h.Unlock()
+}
+
+// playlist is the live m3u8 playlist, segment URLs are relative to it
+func (h *hls) playlist(name string) []byte {
+	h.RLock()
+	defer h.RUnlock()
+	var target time.Duration
+	for _, s := range h.segs {
+		if s.dur > target {
+			target = s.dur
+		}
+	}
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	if len(h.segs) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", h.segs[0].seq)
+	}
+	for _, s := range h.segs {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s/%d.%s\n", s.dur.Seconds(), name, s.seq, h.ext)
+	}
+	return b.Bytes()
+}
+
+// segment finds a segment by its file name
+func (h *hls) segment(file string) (hlsSegment, bool) {
+	seq, err := strconv.Atoi(strings.TrimSuffix(file, "."+h.ext))
+	if err != nil || !strings.HasSuffix(file, "."+h.ext) {
+		return hlsSegment{}, false
+	}
+	h.RLock()
+	defer h.RUnlock()
+	for _, s := range h.segs {
+		if s.seq == seq {
+			return s, true
+		}
+	}
+	return hlsSegment{}, false
+}
+
+// hlsID3 is the ID3 tag that starts a packed audio segment, it has the
+// timestamp of the first frame on the 90kHz MPEG-2 clock and the title
+func hlsID3(pts time.Duration, title string) []byte {
+	ts := make([]byte, 8)
+	ticks := uint64(pts*90000/time.Second) & (1<<33 - 1)
+	for i := range ts {
+		ts[7-i] = byte(ticks >> (8 * uint(i)))
+	}
+	frames := id3Frame("PRIV", append([]byte("com.apple.streaming.transportStreamTimestamp\x00"), ts...))
+	if title != "" {
+		// UTF-8 text
+		frames = append(frames, id3Frame("TIT2", append([]byte{3}, title...))...)
+	}
+	tag := []byte{'I', 'D', '3', 4, 0, 0}
+	tag = append(tag, putSyncsafe(len(frames))...)
+	return append(tag, frames...)
+}
+
+// id3Frame is an ID3v2.4 frame
+func id3Frame(id string, data []byte) []byte {
+	f := append([]byte(id), putSyncsafe(len(data))...)
+	f = append(f, 0, 0)
+	return append(f, data...)
+}
+
+// putSyncsafe is the 4 byte syncsafe form of n
+func putSyncsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+// serveHLS serves the playlist of the mount or one of its segments
+func (s *streamer) serveHLS(w http.ResponseWriter, r *http.Request, file string) {
+	if s.hls == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.allowHLS(w, r) {
+		return
+	}
+	if file == "" {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(s.hls.playlist(s.Name))
+		return
+	}
+	seg, ok := s.hls.segment(file)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", s.Codec.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(seg.data)))
+	w.Write(seg.data)
+}
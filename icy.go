@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Longest metadata block the one byte length prefix can describe
+const icyMaxMeta = 255 * 16
+
+// icyWriter splices shoutcast metadata blocks into the stream every metaint bytes
+type icyWriter struct {
+	w       io.Writer
+	s       *streamer
+	metaint int
+	left    int
+	sent    string
+}
+
+func newIcyWriter(w io.Writer, s *streamer) *icyWriter {
+	return &icyWriter{
+		w:       w,
+		s:       s,
+		metaint: s.MetaInt,
+		left:    s.MetaInt,
+	}
+}
+
+func (i *icyWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > i.left {
+			chunk = chunk[:i.left]
+		}
+		var m int
+		m, err = i.w.Write(chunk)
+		n += m
+		if err != nil {
+			return
+		}
+		p = p[m:]
+		i.left -= m
+		if i.left == 0 {
+			if err = i.writeMeta(); err != nil {
+				return
+			}
+			i.left = i.metaint
+		}
+	}
+	return
+}
+
+// writeMeta sends the title only when it changed, otherwise an empty block
+func (i *icyWriter) writeMeta() error {
+	title := i.s.getTitle()
+	if title == i.sent {
+		_, err := i.w.Write([]byte{0})
+		return err
+	}
+	i.sent = title
+	_, err := i.w.Write(icyMeta(title))
+	return err
+}
+
+// icyMeta builds a length prefixed, zero padded StreamTitle block
+func icyMeta(title string) []byte {
+	meta := fmt.Sprintf("StreamTitle='%s';", title)
+	if len(meta) > icyMaxMeta {
+		meta = meta[:icyMaxMeta-2] + "';"
+	}
+	blocks := (len(meta) + 15) / 16
+	buf := make([]byte, 1+blocks*16)
+	buf[0] = byte(blocks)
+	copy(buf[1:], meta)
+	return buf
+}
+
+// icyReader strips the metadata blocks from an upstream icy stream
+// and reports the titles found in them
+type icyReader struct {
+	r       io.Reader
+	metaint int
+	left    int
+	title   string
+	onTitle func(string)
+}
+
+func newIcyReader(r io.Reader, metaint int, onTitle func(string)) *icyReader {
+	return &icyReader{
+		r:       r,
+		metaint: metaint,
+		left:    metaint,
+		onTitle: onTitle,
+	}
+}
+
+func (i *icyReader) Read(p []byte) (n int, err error) {
+	if i.left == 0 {
+		if err = i.readMeta(); err != nil {
+			return
+		}
+		i.left = i.metaint
+	}
+	if len(p) > i.left {
+		p = p[:i.left]
+	}
+	n, err = i.r.Read(p)
+	i.left -= n
+	return
+}
+
+func (i *icyReader) readMeta() error {
+	var size [1]byte
+	if _, err := io.ReadFull(i.r, size[:]); err != nil {
+		return err
+	}
+	if size[0] == 0 {
+		return nil
+	}
+	meta := make([]byte, int(size[0])*16)
+	if _, err := io.ReadFull(i.r, meta); err != nil {
+		return err
+	}
+	title, ok := parseStreamTitle(string(bytes.TrimRight(meta, "\x00")))
+	if ok && title != i.title {
+		i.title = title
+		if i.onTitle != nil {
+			i.onTitle(title)
+		}
+	}
+	return nil
+}
+
+// parseStreamTitle finds StreamTitle='...'; in a metadata block. Titles
+// aren't escaped, so the value ends before the next field or at the last ';
+func parseStreamTitle(meta string) (string, bool) {
+	const key = "StreamTitle='"
+	start := strings.Index(meta, key)
+	if start < 0 {
+		return "", false
+	}
+	meta = meta[start+len(key):]
+	end := strings.Index(meta, "';Stream")
+	if end < 0 {
+		end = strings.LastIndex(meta, "';")
+	}
+	if end < 0 {
+		return "", false
+	}
+	return meta[:end], true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestIcyRoundTrip(t *testing.T) {
+	payload := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(payload)
+	long := strings.Repeat("x", icyMaxMeta)
+	tests := []struct {
+		metaint int
+		write   int
+		titles  []string
+	}{
+		{1, 1, []string{"one", "two"}},
+		{7, 5, []string{"one", "two"}},
+		{16, 16, []string{"one", "two", "three"}},
+		{4000, 4096, []string{"only"}},
+		{100, 33, []string{"it's", "a ';' b"}},
+		{333, 1000, []string{"", "after silence"}},
+		{50, 17, []string{long}},
+	}
+	for _, tt := range tests {
+		s := &streamer{MetaInt: tt.metaint}
+		var stream bytes.Buffer
+		iw := newIcyWriter(&stream, s)
+		step := len(payload) / len(tt.titles)
+		for i, title := range tt.titles {
+			s.setTitle(title)
+			part := payload[i*step:]
+			if i < len(tt.titles)-1 {
+				part = part[:step]
+			}
+			for len(part) > 0 {
+				n := tt.write
+				if n > len(part) {
+					n = len(part)
+				}
+				if _, err := iw.Write(part[:n]); err != nil {
+					t.Fatal(err)
+				}
+				part = part[n:]
+			}
+		}
+
+		var got []string
+		ir := newIcyReader(iotest.OneByteReader(&stream), tt.metaint, func(title string) {
+			got = append(got, title)
+		})
+		audio, err := ioutil.ReadAll(ir)
+		if err != nil {
+			t.Fatalf("metaint %d: %v", tt.metaint, err)
+		}
+		if !bytes.Equal(audio, payload) {
+			t.Errorf("metaint %d, writes of %d: audio differs", tt.metaint, tt.write)
+		}
+		// The reader starts out with no title, an empty one isn't news
+		var want []string
+		for _, title := range tt.titles {
+			if title == long {
+				title = title[:icyMaxMeta-len("StreamTitle='")-2]
+			}
+			if title != "" {
+				want = append(want, title)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("metaint %d, writes of %d: titles %q, want %q", tt.metaint, tt.write, got, want)
+		}
+	}
+}
+
+func TestIcyMeta(t *testing.T) {
+	tests := []struct {
+		title string
+		size  int
+	}{
+		{"", 1 + 16},
+		{"abc", 1 + 32},
+		{"x", 1 + 16},
+		{"xx", 1 + 32},
+		{strings.Repeat("x", 10000), 1 + icyMaxMeta},
+	}
+	for _, tt := range tests {
+		meta := icyMeta(tt.title)
+		if len(meta) != tt.size {
+			t.Errorf("%d byte title: block of %d, want %d", len(tt.title), len(meta), tt.size)
+		}
+		if int(meta[0])*16 != len(meta)-1 {
+			t.Errorf("%d byte title: length byte %d for %d bytes", len(tt.title), meta[0], len(meta)-1)
+		}
+	}
+}
+
+func TestParseStreamTitle(t *testing.T) {
+	tests := []struct {
+		meta  string
+		title string
+		ok    bool
+	}{
+		{"StreamTitle='Artist - Song';", "Artist - Song", true},
+		{"StreamTitle='';", "", true},
+		{"StreamTitle='Rock 'n' Roll';StreamUrl='http://x';", "Rock 'n' Roll", true},
+		{"StreamUrl='http://x';StreamTitle='Late';", "Late", true},
+		{"StreamTitle='Unterminated", "", false},
+		{"StreamUrl='http://x';", "", false},
+	}
+	for _, tt := range tests {
+		title, ok := parseStreamTitle(tt.meta)
+		if title != tt.title || ok != tt.ok {
+			t.Errorf("parseStreamTitle(%q) = %q, %v, want %q, %v", tt.meta, title, ok, tt.title, tt.ok)
+		}
+	}
+}
+
+// A reader that gives up mid-block reports it, rather than passing
+// metadata off as audio
+func TestIcyReaderTruncated(t *testing.T) {
+	stream := append([]byte("abcd"), icyMeta("cut")[:5]...)
+	ir := newIcyReader(bytes.NewReader(stream), 4, nil)
+	audio, err := ioutil.ReadAll(ir)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("err %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if string(audio) != "abcd" {
+		t.Errorf("audio %q, want %q", audio, "abcd")
+	}
+}
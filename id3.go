@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// id3Tags holds the few tag fields we care about
+type id3Tags struct {
+	Artist string
+	Title  string
+}
+
+// String formats the tags the way players show them, "Artist - Title"
+func (t id3Tags) String() string {
+	switch {
+	case t.Artist != "" && t.Title != "":
+		return t.Artist + " - " + t.Title
+	default:
+		return t.Title
+	}
+}
+
+func syncsafe(b []byte) int {
+	var n int
+	for _, v := range b {
+		n = n<<7 | int(v&0x7f)
+	}
+	return n
+}
+
+func bigEndian(b []byte) int {
+	var n int
+	for _, v := range b {
+		n = n<<8 | int(v)
+	}
+	return n
+}
+
+// readID3v2 consumes an ID3v2 tag at the start of r, if there is one
+func readID3v2(r *bufio.Reader) (tags id3Tags, err error) {
+	head, err := r.Peek(10)
+	if err != nil || string(head[:3]) != "ID3" {
+		return tags, nil
+	}
+	version := head[3]
+	flags := head[5]
+	size := syncsafe(head[6:10])
+	if flags&0x10 != 0 {
+		size += 10
+	}
+	if _, err = r.Discard(10); err != nil {
+		return
+	}
+	body := make([]byte, size)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	if flags&0x40 != 0 && version > 2 && len(body) >= 4 {
+		ext := bigEndian(body[:4]) + 4
+		if version == 4 {
+			ext = syncsafe(body[:4])
+		}
+		if ext > len(body) {
+			return
+		}
+		body = body[ext:]
+	}
+	idLen, headLen := 4, 10
+	if version == 2 {
+		idLen, headLen = 3, 6
+	}
+	for len(body) >= headLen && body[0] != 0 {
+		id := string(body[:idLen])
+		var fsize int
+		switch version {
+		case 2:
+			fsize = bigEndian(body[3:6])
+		case 3:
+			fsize = bigEndian(body[4:8])
+		default:
+			fsize = syncsafe(body[4:8])
+		}
+		if fsize > len(body)-headLen {
+			break
+		}
+		data := body[headLen : headLen+fsize]
+		switch id {
+		case "TIT2", "TT2":
+			tags.Title = id3Text(data)
+		case "TPE1", "TP1":
+			tags.Artist = id3Text(data)
+		}
+		body = body[headLen+fsize:]
+	}
+	return
+}
+
+// readID3v1 parses a 128 byte ID3v1 tag, ok is false if it isn't one
+func readID3v1(b []byte) (tags id3Tags, ok bool) {
+	if len(b) != 128 || string(b[:3]) != "TAG" {
+		return
+	}
+	tags.Title = latin1(bytes.TrimRight(b[3:33], "\x00 "))
+	tags.Artist = latin1(bytes.TrimRight(b[33:63], "\x00 "))
+	return tags, true
+}
+
+// id3Text decodes a text frame, the first byte is the encoding
+func id3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var s string
+	switch b[0] {
+	case 0:
+		s = latin1(b[1:])
+	case 1, 2:
+		s = utf16Text(b[1:], b[0] == 2)
+	default:
+		s = string(b[1:])
+	}
+	// Multiple values are NUL separated, the first one will do
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func latin1(b []byte) string {
+	r := make([]rune, len(b))
+	for i, v := range b {
+		r[i] = rune(v)
+	}
+	return string(r)
+}
+
+func utf16Text(b []byte, bigendian bool) string {
+	if len(b) >= 2 {
+		switch {
+		case b[0] == 0xff && b[1] == 0xfe:
+			bigendian = false
+			b = b[2:]
+		case b[0] == 0xfe && b[1] == 0xff:
+			bigendian = true
+			b = b[2:]
+		}
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if bigendian {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		} else {
+			u[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+		}
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// openInput opens a mount's input. "-" is stdin, "exec:" runs a shell
+// command and reads its output, http(s) URLs are relayed, anything else
+// is opened as a file or a FIFO. onTitle gets titles found in the input
+func openInput(spec string, onTitle func(string)) (io.ReadCloser, error) {
+	switch {
+	case spec == "-":
+		return os.Stdin, nil
+	case strings.HasPrefix(spec, "exec:"):
+		return openCommand(strings.TrimPrefix(spec, "exec:"))
+	case isURL(spec):
+		return openURL(spec, onTitle)
+	}
+	return os.Open(spec)
+}
+
+// cmdReader is the output of a running command,
+// closing it kills the command
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func openCommand(command string) (io.ReadCloser, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{out, cmd}, nil
+}
+
+func (c *cmdReader) Close() error {
+	c.cmd.Process.Kill()
+	c.ReadCloser.Close()
+	return c.cmd.Wait()
+}
+
+// reopen replaces the input of a streamer. When the last input gave
+// nothing, each try waits twice as long as the one before, up to MaxRetry
+func (s *streamer) reopen() {
+	if s.input != nil {
+		s.input.Close()
+	}
+	for {
+		if s.backoff > 0 {
+			log.Printf("%s: reopening input in %v\n", s.Name, s.backoff)
+			time.Sleep(s.backoff)
+		}
+		s.backoff *= 2
+		if s.backoff < time.Second {
+			s.backoff = time.Second
+		}
+		if s.backoff > s.MaxRetry {
+			s.backoff = s.MaxRetry
+		}
+		input, err := s.Open()
+		if err != nil {
+			log.Printf("%s: %v\n", s.Name, err)
+			continue
+		}
+		s.input = input
+		s.dec = s.Codec.newDecoder(input)
+		return
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	goupnp "github.com/NebulousLabs/go-upnp"
@@ -16,6 +19,10 @@ import (
 
 var usage = `
 Usage: cat *.wav | lame - - | dumb-mp3-streamer [options...]
+       dumb-mp3-streamer -mount jazz=/run/jazz.fifo -mount talk=/run/talk.fifo
+       dumb-mp3-streamer -playlist ~/Music
+       dumb-mp3-streamer -relay http://example.com:8000/stream
+       arecord -f S16_LE -r 48000 -c 2 | dumb-mp3-streamer -format pcm
 
 Options:
 	-port 		Portnumber for server (max 65535). Default: 8080
@@ -23,6 +30,62 @@ Options:
 	-readsize	Number of seconds of mp3 audio to read at once. Default: 1
 	-queue		Number of unsent chunks before dropping data. Default: 10
 	-writebuff	Write buffer. Default: 32768
+	-format		Format of the inputs: mp3, aac (ADTS), ogg (Opus, Vorbis,
+			FLAC), flac or pcm. Remote sources go by their Content-Type.
+			Default: mp3
+	-rate		Sample rate of pcm input. Default: 48000
+	-channels	Channels of pcm input. Default: 2
+	-bits		Bits per sample of pcm input, signed little endian
+			(unsigned if 8). A WAV header on the input overrides
+			all three. Default: 16
+	-metaint	Bytes between shoutcast metadata blocks. Default: 16000
+	-stall		Seconds without input before sending silence, 0 disables. Default: 0
+	-formatchange	What to do when the input changes sample rate, channels or layer:
+			keep passes it on, drop drops the frames not in the first format,
+			cut disconnects clients so players start over. Default: keep
+	-clock		What paces the stream: output sleeps to send the audio in
+			real time, input sends it as it comes from a real time
+			source like arecord | lame. The drift of the input
+			is logged either way. Default: output
+	-title		Initial stream title sent as shoutcast metadata
+	-name		Station name shown by the web player at / and put in the
+			/name.m3u, .pls and .xspf playlists of mounts. Default: dumb-mp3-streamer
+	-genre		Station genre put in the playlists
+	-adminuser	Username for the /admin endpoints. Default: admin
+	-adminpass	Password for the /admin endpoints, admin is disabled if empty
+	-sourceuser	Username for SOURCE/PUT encoder connections. Default: source
+	-sourcepass	Password for SOURCE/PUT encoder connections, disabled if empty
+	-listenuser	Let only listeners in who log in, as user:pass. Can be repeated.
+	-htpasswd	Let only listeners in who are in an htpasswd file, bcrypt
+			or SHA1 hashes. It's read again when it changes.
+	-authurl	Ask a URL about every listener, the way Icecast does with
+			listener_add and listener_remove
+	-trustproxy	Take the address of listeners from the X-Forwarded-For
+			header, only behind a reverse proxy that adds it
+	-mount		Serve input at /name, as name=path, "-" is stdin. Can be repeated.
+			A directory or an M3U file is played as a playlist,
+			exec:command reads the output of a shell command
+			and a http(s) URL is relayed.
+			Default: stream=-
+	-reopen		Reopen inputs that end or fail instead of shutting down, not stdin.
+			URLs are always reconnected.
+	-retry		Max seconds between attempts to reopen an input. Default: 30
+	-playlist	Play the mp3 files of a directory or an M3U file at /stream, in a loop
+	-relay		Relay an upstream http/icy stream at /stream, titles included
+	-timeshift	Minutes of audio to keep on disk, so listeners can start
+			back in time with /stream?offset=-600, in seconds. 0 disables.
+			Default: 0
+	-timeshiftdir	Where to keep it, a directory per mount.
+			Default: $TMPDIR/dumb-mp3-streamer
+	-hls		Seconds of audio per HLS segment, 0 disables. The playlist
+			of a mount is at /name.m3u8. Default: 0
+	-archivedir	Record every mount as sent to clients, into a directory per mount
+	-archivename	strftime template of the archive files, the extension goes
+			by format. A new file starts when the name changes, %t is the
+			title, for a file a show. Default: %Y-%m-%d_%H
+	-archivekeep	Days to keep archive files, 0 keeps them. Default: 0
+	-archivesize	MB of archive files to keep a mount, oldest go first,
+			0 is no limit. Default: 0
 	-upnp		Use to forward the port on the router
 
 `
@@ -34,18 +97,81 @@ func main() {
 	var readSize *int
 	var queueSize *int
 	var writeBuff *int
+	var metaInt *int
+	var stall *int
+	var title *string
+	var name *string
+	var genre *string
+	var formatChange = formatFlag(formatKeep)
+	var clock = clockFlag(clockOutput)
+	var format = codecFlag{codecs["mp3"]}
+	var pcmRate *int
+	var pcmChannels *int
+	var pcmBits *int
+	var adminUser *string
+	var adminPass *string
+	var sourceUser *string
+	var sourcePass *string
+	var listenUsers = make(userFlag)
+	var htpasswdPath *string
+	var authURL *string
+	var trustProxy *bool
+	var reopen *bool
+	var maxRetry *int
+	var playlistPath *string
+	var relay *string
+	var timeShift *int
+	var shiftDir *string
+	var hlsTime *int
+	var archiveDir *string
+	var archiveName *string
+	var archiveKeep *int
+	var archiveSize *int
+	var mountSpecs mountFlag
 	var c = make(chan os.Signal, 2)
 	port = flag.Uint("port", 8080, "Server Port")
 	buffSize = flag.Int("buffer", 10, "buffer size in seconds")
 	readSize = flag.Int("readsize", 1, "how many seconds read from source at once")
 	queueSize = flag.Int("queue", 10, "queue size")
 	writeBuff = flag.Int("writebuff", 32768, "write buffer size")
+	metaInt = flag.Int("metaint", 16000, "metadata interval")
+	stall = flag.Int("stall", 0, "seconds without input before sending silence")
+	flag.Var(&format, "format", "input format")
+	pcmRate = flag.Int("rate", 48000, "pcm sample rate")
+	pcmChannels = flag.Int("channels", 2, "pcm channels")
+	pcmBits = flag.Int("bits", 16, "pcm bits per sample")
+	flag.Var(&formatChange, "formatchange", "keep, drop or cut on format changes")
+	flag.Var(&clock, "clock", "output or input pacing")
+	title = flag.String("title", "", "initial stream title")
+	name = flag.String("name", "dumb-mp3-streamer", "station name")
+	genre = flag.String("genre", "", "station genre")
+	adminUser = flag.String("adminuser", "admin", "admin username")
+	adminPass = flag.String("adminpass", "", "admin password")
+	sourceUser = flag.String("sourceuser", "source", "source username")
+	sourcePass = flag.String("sourcepass", "", "source password")
+	flag.Var(listenUsers, "listenuser", "user:pass of a listener, can be repeated")
+	htpasswdPath = flag.String("htpasswd", "", "htpasswd file of listeners")
+	authURL = flag.String("authurl", "", "listener auth URL")
+	trustProxy = flag.Bool("trustproxy", false, "take client addresses from X-Forwarded-For")
 	upnp = flag.Bool("upnp", false, "Enable upnp port forwarding")
+	reopen = flag.Bool("reopen", false, "reopen inputs that end")
+	maxRetry = flag.Int("retry", 30, "max seconds between reopen attempts")
+	playlistPath = flag.String("playlist", "", "directory or M3U file to play")
+	relay = flag.String("relay", "", "upstream stream to relay")
+	timeShift = flag.Int("timeshift", 0, "minutes of audio to keep on disk")
+	shiftDir = flag.String("timeshiftdir", filepath.Join(os.TempDir(), "dumb-mp3-streamer"), "time-shift directory")
+	hlsTime = flag.Int("hls", 0, "seconds of audio per HLS segment")
+	archiveDir = flag.String("archivedir", "", "directory to record the mounts to")
+	archiveName = flag.String("archivename", "%Y-%m-%d_%H", "strftime template of archive files")
+	archiveKeep = flag.Int("archivekeep", 0, "days to keep archive files")
+	archiveSize = flag.Int("archivesize", 0, "MB of archive files to keep per mount")
+	flag.Var(&mountSpecs, "mount", "name=path of a mount, can be repeated")
 
 	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, fmt.Sprintf(usage))
+		fmt.Fprint(os.Stderr, usage)
 	}
 	flag.Parse()
+	started := time.Now()
 	if *port > 65535 {
 		fmt.Fprint(os.Stderr, "error: invalid port number\n")
 		return
@@ -66,26 +192,185 @@ func main() {
 		fmt.Fprint(os.Stderr, "error: writebuff size too small\n")
 		return
 	}
+	if *metaInt < 1 {
+		fmt.Fprint(os.Stderr, "error: metaint too small\n")
+		return
+	}
+	if *stall < 0 {
+		fmt.Fprint(os.Stderr, "error: stall can't be negative\n")
+		return
+	}
+	if *maxRetry < 1 {
+		fmt.Fprint(os.Stderr, "error: retry too small\n")
+		return
+	}
+	if *timeShift < 0 {
+		fmt.Fprint(os.Stderr, "error: timeshift can't be negative\n")
+		return
+	}
+	if *hlsTime < 0 {
+		fmt.Fprint(os.Stderr, "error: hls can't be negative\n")
+		return
+	}
+	if *hlsTime > 0 && format.name != "mp3" && format.name != "aac" {
+		fmt.Fprint(os.Stderr, "error: hls is for mp3 and aac only\n")
+		return
+	}
+	if *archiveKeep < 0 || *archiveSize < 0 {
+		fmt.Fprint(os.Stderr, "error: archive limits can't be negative\n")
+		return
+	}
+	if *archiveName == "" {
+		fmt.Fprint(os.Stderr, "error: archivename can't be empty\n")
+		return
+	}
+	if *pcmRate < 1 {
+		fmt.Fprint(os.Stderr, "error: rate too small\n")
+		return
+	}
+	if *pcmChannels < 1 || *pcmChannels > 255 {
+		fmt.Fprint(os.Stderr, "error: invalid number of channels\n")
+		return
+	}
+	switch *pcmBits {
+	case 8, 16, 24, 32:
+	default:
+		fmt.Fprint(os.Stderr, "error: bits must be 8, 16, 24 or 32\n")
+		return
+	}
+	if format.name == "pcm" {
+		format.codec = newPCMCodec(pcmFormat{*pcmRate, *pcmChannels, *pcmBits})
+	}
+	var users *htpasswd
+	if *htpasswdPath != "" {
+		var err error
+		users, err = newHtpasswd(*htpasswdPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return
+		}
+	}
+	if *authURL != "" && !isURL(*authURL) {
+		fmt.Fprint(os.Stderr, "error: authurl needs a http(s) URL\n")
+		return
+	}
 
-	str := new(streamer)
-	str.Input = os.Stdin
-	str.ReadSize = time.Duration(*readSize) * time.Second
-	str.BuffSize = time.Duration(*buffSize) * time.Second
-	str.QueueSize = *queueSize
-	str.WriteBuff = *writeBuff
-	err := str.init()
-	if err != nil {
-		log.Fatalln(err)
+	conf := &streamConfig{
+		ReadSize:  time.Duration(*readSize) * time.Second,
+		BuffSize:  time.Duration(*buffSize) * time.Second,
+		QueueSize: *queueSize,
+		WriteBuff: *writeBuff,
+		MetaInt:   *metaInt,
+		Stall:     time.Duration(*stall) * time.Second,
+		MaxRetry:  time.Duration(*maxRetry) * time.Second,
+		FmtChange: formatChange,
+		Clock:     clock,
+		ShiftKeep: time.Duration(*timeShift) * time.Minute,
+		ShiftDir:  *shiftDir,
+		HLSTime:   time.Duration(*hlsTime) * time.Second,
+		Codec:     format.codec,
+		Auth:      newListenAuth(listenUsers, users, *authURL),
+		Archive: archiveConfig{
+			Dir:     *archiveDir,
+			Name:    *archiveName,
+			MaxAge:  time.Duration(*archiveKeep) * 24 * time.Hour,
+			MaxSize: int64(*archiveSize) << 20,
+		},
+	}
+	if *playlistPath != "" {
+		if format.name != "mp3" {
+			fmt.Fprint(os.Stderr, "error: playlists only play mp3\n")
+			return
+		}
+		if err := mountSpecs.Set("stream=" + *playlistPath); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return
+		}
+	}
+	if *relay != "" {
+		if !isURL(*relay) {
+			fmt.Fprint(os.Stderr, "error: relay needs a http(s) URL\n")
+			return
+		}
+		if err := mountSpecs.Set("stream=" + *relay); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return
+		}
+	}
+	if len(mountSpecs) == 0 && *sourcePass == "" {
+		mountSpecs = mountFlag{{"stream", "-"}}
+	}
+	mounts := newMountList()
+	mounts.source = &source{
+		User:   *sourceUser,
+		Pass:   *sourcePass,
+		conf:   conf,
+		mounts: mounts,
+	}
+	pl := &player{
+		Name:   *name,
+		Genre:  *genre,
+		mounts: mounts,
+	}
+	mounts.player = pl
+	var names []string
+	var wg sync.WaitGroup
+	for _, spec := range mountSpecs {
+		names = append(names, spec.name)
+		// Sources can't take the name while the mount fills its buffer
+		if err := mounts.reserve(spec.name); err != nil {
+			log.Fatalln(err)
+		}
+		wg.Add(1)
+		go func(spec mountSpec) {
+			defer wg.Done()
+			str := conf.newStreamer(spec.name, nil)
+			str.title = *title
+			if isPlaylist(spec.path) {
+				if str.Codec.name != "mp3" {
+					log.Fatalf("%s: playlists only play mp3\n", spec.name)
+				}
+				pl := newPlaylist(spec.path, str.setTitle)
+				defer pl.Close()
+				str.Frames = pl
+			} else if (*reopen || isURL(spec.path)) && spec.path != "-" {
+				str.Open = func() (io.ReadCloser, error) {
+					return openInput(spec.path, str.setTitle)
+				}
+			} else {
+				input, err := openInput(spec.path, str.setTitle)
+				if err != nil {
+					log.Fatalln(err)
+				}
+				defer input.Close()
+				str.Input = input
+			}
+			if err := str.init(); err != nil {
+				log.Fatalf("%s: %v\n", spec.name, err)
+			}
+			if err := mounts.add(str); err != nil {
+				log.Fatalln(err)
+			}
+			defer mounts.del(spec.name)
+			str.readLoop()
+		}(spec)
+	}
+	// Remote sources come and go, only the local inputs ending stops us
+	done := make(chan bool)
+	if len(mountSpecs) > 0 {
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
 	}
-	go str.readLoop()
 
-	printIP(*upnp, *port)
+	printIP(*upnp, *port, names)
 
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		select {
 		case <-c:
-		case <-str.Stop:
+		case <-done:
 		}
 		log.Println("Shutting Down!")
 		if *upnp {
@@ -100,23 +385,43 @@ func main() {
 	srv := &http.Server{
 		Addr: fmt.Sprintf(":%d", *port),
 	}
-	http.Handle("/stream", str)
+	adm := &admin{
+		User:   *adminUser,
+		Pass:   *adminPass,
+		mounts: mounts,
+	}
+	http.Handle("/", mounts)
+	http.HandleFunc("/admin/metadata", adm.metadata)
+	http.HandleFunc("/admin/listclients", adm.listclients)
+	http.HandleFunc("/admin/killclient", adm.killclient)
+	http.HandleFunc("/embed", pl.embed)
+	http.HandleFunc("/nowplaying.json", pl.nowPlaying)
+	st := &status{pl, started}
+	http.HandleFunc("/status", st.native)
+	http.HandleFunc("/status-json.xsl", st.icecast)
+	http.Handle("/metrics", &metrics{mounts})
+	clp := &clips{mounts}
+	http.HandleFunc("/clip", clp.clip)
+	http.HandleFunc("/clip.json", clp.list)
+	if *trustProxy {
+		srv.Handler = fromProxy(http.DefaultServeMux)
+	}
 	log.Fatalln(srv.ListenAndServe())
 }
 
-func printIP(upnp bool, port uint) {
+func printIP(upnp bool, port uint, names []string) {
+	var hosts []string
 	if upnp {
 		ip, err := forward(port)
 		if err != nil {
 			log.Println("Upnp forwarding failed!")
 		} else {
-			log.Printf("Starting Streaming on http://%s:%d/stream\n", ip, port)
+			hosts = append(hosts, ip)
 		}
 	}
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		log.Println(err)
-		return
 	}
 	for _, addr := range addrs {
 		net, ok := addr.(*net.IPNet)
@@ -124,9 +429,14 @@ func printIP(upnp bool, port uint) {
 			continue
 		}
 		if strings.Contains(net.IP.String(), ":") {
-			log.Printf("Starting Streaming on http://[%s]:%d/stream\n", net.IP, port)
+			hosts = append(hosts, fmt.Sprintf("[%s]", net.IP))
 		} else {
-			log.Printf("Starting Streaming on http://%s:%d/stream\n", net.IP, port)
+			hosts = append(hosts, net.IP.String())
+		}
+	}
+	for _, host := range hosts {
+		for _, name := range names {
+			log.Printf("Starting Streaming on http://%s:%d/%s\n", host, port, name)
 		}
 	}
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// counters are the running totals of a mount for /metrics,
+// guarded by the lock of the streamer
+type counters struct {
+	// Clients that ever connected
+	connections uint64
+	// Chunks not sent because the queue of a client was full,
+	// counted under the read lock by send
+	dropChunks atomic.Uint64
+	// Frames from the input and the bytes the decoder skipped to find them
+	decoded uint64
+	skipped uint64
+	// Times readLoop slept to pace the stream and the seconds it slept
+	sleeps uint64
+	slept  float64
+}
+
+// metric is a Prometheus metric with a value for each mount
+type metric struct {
+	name  string
+	typ   string
+	help  string
+	value func(s *streamer) string
+}
+
+func counter(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
+
+func float(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricsList is what /metrics reports, the streamer lock is held for value
+var metricsList = []metric{
+	{"streamer_listeners", "gauge", "Listeners connected now.", func(s *streamer) string {
+		return strconv.Itoa(len(s.clients) + len(s.shifted))
+	}},
+	{"streamer_listeners_total", "counter", "Listeners that connected.", func(s *streamer) string {
+		return counter(s.count.connections)
+	}},
+	{"streamer_dropped_chunks_total", "counter", "Chunks dropped because a listener's queue was full.", func(s *streamer) string {
+		return counter(s.count.dropChunks.Load())
+	}},
+	{"streamer_sent_bytes_total", "counter", "Bytes written to listeners.", func(s *streamer) string {
+		return counter(s.sent.Load())
+	}},
+	{"streamer_input_frames_total", "counter", "Frames decoded from the input.", func(s *streamer) string {
+		return counter(s.count.decoded)
+	}},
+	{"streamer_input_skipped_bytes_total", "counter", "Bytes of the input the decoder skipped as garbage.", func(s *streamer) string {
+		return counter(s.count.skipped)
+	}},
+	{"streamer_drift_seconds", "gauge", "How far the input ran ahead of real time, negative when behind.", func(s *streamer) string {
+		return float(s.drift.Seconds())
+	}},
+	{"streamer_pacing_sleeps_total", "counter", "Times the read loop slept to pace the stream.", func(s *streamer) string {
+		return counter(s.count.sleeps)
+	}},
+	{"streamer_pacing_sleep_seconds_total", "counter", "Seconds the read loop slept to pace the stream.", func(s *streamer) string {
+		return float(s.count.slept)
+	}},
+	{"streamer_stalled", "gauge", "1 when the input has stalled and silence is sent.", func(s *streamer) string {
+		if s.stalled {
+			return "1"
+		}
+		return "0"
+	}},
+}
+
+// metrics serves the counters of the mounts in the Prometheus text format
+type metrics struct {
+	mounts *mountList
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var strs []*streamer
+	for _, name := range m.mounts.names() {
+		if s, ok := m.mounts.get(name); ok {
+			strs = append(strs, s)
+		}
+	}
+	var b bytes.Buffer
+	for _, mt := range metricsList {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", mt.name, mt.help, mt.name, mt.typ)
+		for _, s := range strs {
+			s.RLock()
+			v := mt.value(s)
+			s.RUnlock()
+			fmt.Fprintf(&b, "%s{mount=%q} %s\n", mt.name, s.Name, v)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b.WriteTo(w)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamConfig holds the settings shared by every mount
+type streamConfig struct {
+	BuffSize  time.Duration
+	ReadSize  time.Duration
+	QueueSize int
+	WriteBuff int
+	MetaInt   int
+	Stall     time.Duration
+	MaxRetry  time.Duration
+	FmtChange formatFlag
+	Clock     clockFlag
+	ShiftKeep time.Duration
+	ShiftDir  string
+	Archive   archiveConfig
+	HLSTime   time.Duration
+	Auth      *listenAuth
+	Codec     *codec
+}
+
+func (c *streamConfig) newStreamer(name string, input io.Reader) *streamer {
+	str := new(streamer)
+	str.Name = name
+	str.Input = input
+	str.BuffSize = c.BuffSize
+	str.ReadSize = c.ReadSize
+	str.QueueSize = c.QueueSize
+	str.WriteBuff = c.WriteBuff
+	str.MetaInt = c.MetaInt
+	str.Stall = c.Stall
+	str.MaxRetry = c.MaxRetry
+	str.FmtChange = c.FmtChange
+	str.Clock = c.Clock
+	str.ShiftKeep = c.ShiftKeep
+	str.ShiftDir = c.ShiftDir
+	str.Archive = c.Archive
+	str.HLSTime = c.HLSTime
+	str.Auth = c.Auth
+	str.Codec = c.Codec
+	return str
+}
+
+type mountSpec struct {
+	name string
+	path string
+}
+
+// mountFlag collects repeated -mount name=path flags
+type mountFlag []mountSpec
+
+func (m *mountFlag) String() string {
+	var s []string
+	for _, v := range *m {
+		s = append(s, v.name+"="+v.path)
+	}
+	return strings.Join(s, ",")
+}
+
+func (m *mountFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("expected name=path, got %q", v)
+	}
+	name, path := v[:i], v[i+1:]
+	if err := validMount(name); err != nil {
+		return err
+	}
+	if path == "" {
+		return fmt.Errorf("mount %s has no input", name)
+	}
+	for _, spec := range *m {
+		if spec.name == name {
+			return fmt.Errorf("mount %s declared twice", name)
+		}
+	}
+	*m = append(*m, mountSpec{name, path})
+	return nil
+}
+
+func validMount(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("empty mount name")
+	case strings.ContainsAny(name, "/?#"):
+		return fmt.Errorf("invalid mount name %q", name)
+	case name == "admin", name == "clip", name == "clip.json",
+		name == "embed", name == "nowplaying.json",
+		name == "status", name == "status-json.xsl", name == "metrics":
+		return fmt.Errorf("mount name %q is reserved", name)
+	}
+	return nil
+}
+
+// mountList routes requests to the streamer of the mount named in the path
+type mountList struct {
+	sync.RWMutex
+	m map[string]*streamer
+	// Names of mounts still filling their buffer
+	reserved map[string]bool
+	source   http.Handler
+	player   *player
+}
+
+func newMountList() *mountList {
+	return &mountList{
+		m:        make(map[string]*streamer),
+		reserved: make(map[string]bool),
+	}
+}
+
+// reserve holds the name of a mount while it starts, so no other
+// mount can take it meanwhile. del lets go of it if it doesn't start
+func (ml *mountList) reserve(name string) error {
+	ml.Lock()
+	defer ml.Unlock()
+	if _, ok := ml.m[name]; ok || ml.reserved[name] {
+		return fmt.Errorf("mount %s already exists", name)
+	}
+	ml.reserved[name] = true
+	return nil
+}
+
+// add puts a mount that has started under the name it reserved
+func (ml *mountList) add(s *streamer) error {
+	ml.Lock()
+	defer ml.Unlock()
+	if _, ok := ml.m[s.Name]; ok {
+		return fmt.Errorf("mount %s already exists", s.Name)
+	}
+	delete(ml.reserved, s.Name)
+	ml.m[s.Name] = s
+	return nil
+}
+
+func (ml *mountList) del(name string) {
+	ml.Lock()
+	defer ml.Unlock()
+	delete(ml.m, name)
+	delete(ml.reserved, name)
+}
+
+func (ml *mountList) get(name string) (*streamer, bool) {
+	ml.RLock()
+	defer ml.RUnlock()
+	s, ok := ml.m[strings.TrimPrefix(name, "/")]
+	return s, ok
+}
+
+func (ml *mountList) names() []string {
+	ml.RLock()
+	defer ml.RUnlock()
+	names := make([]string, 0, len(ml.m))
+	for name := range ml.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (ml *mountList) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "SOURCE" || r.Method == http.MethodPut {
+		ml.source.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/" {
+		ml.player.ServeHTTP(w, r)
+		return
+	}
+	s, ok := ml.get(r.URL.Path)
+	if ok {
+		s.ServeHTTP(w, r)
+		return
+	}
+	// Playlist files of a mount
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	ext := filepath.Ext(path)
+	if _, ok := playlistTypes[ext]; ok {
+		if s, ok := ml.get(strings.TrimSuffix(path, ext)); ok {
+			ml.player.playlist(w, r, s, ext)
+			return
+		}
+	}
+	// HLS, the playlist of a mount is at /name.m3u8 and its segments under /name/
+	if name := strings.TrimSuffix(path, ".m3u8"); name != path {
+		if s, ok := ml.get(name); ok {
+			s.serveHLS(w, r, "")
+			return
+		}
+	} else if i := strings.Index(path, "/"); i > 0 {
+		if s, ok := ml.get(path[:i]); ok {
+			s.serveHLS(w, r, path[i+1:])
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// lookup finds the mount a request is for, replying with an error if
+// there's none. The mount can be omitted when only one is running
+func (ml *mountList) lookup(w http.ResponseWriter, name string) (*streamer, bool) {
+	if name == "" {
+		names := ml.names()
+		if len(names) != 1 {
+			http.Error(w, "missing mount", http.StatusBadRequest)
+			return nil, false
+		}
+		name = names[0]
+	}
+	str, ok := ml.get(name)
+	if !ok {
+		http.Error(w, "mount not found", http.StatusNotFound)
+	}
+	return str, ok
+}
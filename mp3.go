@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/tcolgate/mp3"
+)
+
+// frameReader yields mp3 frames, *mp3.Decoder is the plain one
+type frameReader interface {
+	Decode(v *mp3.Frame, skipped *int) error
+}
+
+// mp3Decoder turns mp3 frames into stream frames,
+// leaving out what gapless playback has no use for
+type mp3Decoder struct {
+	r       frameReader
+	frame   *mp3.Frame
+	gapless gapless
+}
+
+func newMP3Decoder(r frameReader) *mp3Decoder {
+	return &mp3Decoder{
+		r:     r,
+		frame: new(mp3.Frame),
+	}
+}
+
+func (d *mp3Decoder) next() (frame, error) {
+	var skipped int
+	for {
+		var n int
+		if err := d.r.Decode(d.frame, &n); err != nil {
+			return frame{}, err
+		}
+		skipped += n
+		if d.gapless.keep(d.frame) {
+			f := newMP3Frame(d.frame)
+			f.skipped = skipped
+			return f, nil
+		}
+	}
+}
+
+func newMP3Frame(f *mp3.Frame) frame {
+	b := frameBytes(f)
+	h := mp3.FrameHeader(b[:4])
+	return frame{
+		data:   b,
+		dur:    f.Duration(),
+		format: mp3Format(h),
+		header: h,
+	}
+}
+
+func mp3Format(h mp3.FrameHeader) audioFormat {
+	channels := 2
+	if h.ChannelMode() == mp3.SingleChannel {
+		channels = 1
+	}
+	return audioFormat{
+		Codec:      fmt.Sprintf("%v %v", h.Version(), h.Layer()),
+		SampleRate: int(h.SampleRate()),
+		Channels:   channels,
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+var oggCRCTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return
+}()
+
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+	for i, b := range page {
+		// The checksum field itself counts as zeroes
+		if i >= 22 && i < 26 {
+			b = 0
+		}
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// Header, 255 lacing values and 255 segments of 255 bytes
+const oggMaxPage = 27 + 255 + 255*255
+
+// oggPage is a raw Ogg page
+type oggPage []byte
+
+func (p oggPage) bos() bool {
+	return p[5]&0x02 != 0
+}
+
+func (p oggPage) granule() int64 {
+	return int64(binary.LittleEndian.Uint64(p[6:14]))
+}
+
+func (p oggPage) serial() uint32 {
+	return binary.LittleEndian.Uint32(p[14:18])
+}
+
+func (p oggPage) segments() []byte {
+	return p[27 : 27+int(p[26])]
+}
+
+// body is the page data after the segment table
+func (p oggPage) body() []byte {
+	return p[27+int(p[26]):]
+}
+
+// packetEnds counts the packets that end on this page
+func (p oggPage) packetEnds() int {
+	var n int
+	for _, l := range p.segments() {
+		if l < 255 {
+			n++
+		}
+	}
+	return n
+}
+
+// oggStream is what we know about the logical stream being carried
+type oggStream struct {
+	serial uint32
+	rate   int
+	format audioFormat
+	// Header pages and how many header packets there are and have been seen
+	head    []byte
+	needed  int
+	packets int
+	// The granule audio is paced from, the first one seen after the headers
+	granule int64
+	started bool
+}
+
+// oggDecoder splits an Ogg stream into pages and paces them by granule
+// position. The header pages of the stream are kept aside and handed
+// along with every audio page, so they can be replayed to new clients
+type oggDecoder struct {
+	r      *bufio.Reader
+	stream *oggStream
+}
+
+func newOggDecoder(r io.Reader) *oggDecoder {
+	return &oggDecoder{
+		r: bufio.NewReaderSize(r, oggMaxPage),
+	}
+}
+
+// readPage reads the next page with a valid checksum
+func (d *oggDecoder) readPage() (page oggPage, skipped int, err error) {
+	for {
+		var head []byte
+		head, err = d.r.Peek(27)
+		if err != nil {
+			return
+		}
+		if string(head[:4]) != "OggS" || head[4] != 0 {
+			d.r.Discard(1)
+			skipped++
+			continue
+		}
+		var segs []byte
+		segs, err = d.r.Peek(27 + int(head[26]))
+		if err != nil {
+			return
+		}
+		size := len(segs)
+		for _, l := range segs[27:] {
+			size += int(l)
+		}
+		var raw []byte
+		raw, err = d.r.Peek(size)
+		if err != nil {
+			return
+		}
+		if oggCRC(raw) != binary.LittleEndian.Uint32(raw[22:26]) {
+			// Not a page after all
+			d.r.Discard(1)
+			skipped++
+			continue
+		}
+		page = make(oggPage, size)
+		copy(page, raw)
+		d.r.Discard(size)
+		return
+	}
+}
+
+func (d *oggDecoder) next() (frame, error) {
+	var skipped int
+	for {
+		page, n, err := d.readPage()
+		skipped += n
+		if err != nil {
+			return frame{}, err
+		}
+		if page.bos() {
+			st, err := newOggStream(page)
+			if err != nil {
+				// Like the video of a multiplexed stream
+				log.Println(err)
+				skipped += len(page)
+				continue
+			}
+			d.stream = st
+			continue
+		}
+		st := d.stream
+		if st == nil || page.serial() != st.serial {
+			// Pages of a stream we don't have headers for
+			skipped += len(page)
+			continue
+		}
+		if st.packets < st.needed {
+			st.head = append(st.head, page...)
+			st.packets += page.packetEnds()
+			continue
+		}
+		var dur time.Duration
+		if g := page.granule(); g != -1 {
+			// Streams joined midway, like relays, don't start at 0
+			if st.started && g > st.granule {
+				dur = time.Duration(g-st.granule) * time.Second / time.Duration(st.rate)
+			}
+			st.granule = g
+			st.started = true
+		}
+		return frame{
+			data:    page,
+			dur:     dur,
+			format:  st.format,
+			head:    st.head,
+			skipped: skipped,
+		}, nil
+	}
+}
+
+// newOggStream starts a logical stream from its first page,
+// which holds the identification header of the codec
+func newOggStream(page oggPage) (*oggStream, error) {
+	st := &oggStream{
+		serial:  page.serial(),
+		head:    append([]byte(nil), page...),
+		packets: page.packetEnds(),
+	}
+	id := page.body()
+	switch {
+	case len(id) >= 19 && string(id[:8]) == "OpusHead":
+		// Opus granules always count at 48kHz
+		st.rate = 48000
+		st.needed = 2
+		st.format = audioFormat{
+			Codec:      "Opus",
+			SampleRate: int(binary.LittleEndian.Uint32(id[12:16])),
+			Channels:   int(id[9]),
+		}
+	case len(id) >= 30 && string(id[:7]) == "\x01vorbis":
+		st.rate = int(binary.LittleEndian.Uint32(id[12:16]))
+		st.needed = 3
+		st.format = audioFormat{
+			Codec:      "Vorbis",
+			SampleRate: st.rate,
+			Channels:   int(id[11]),
+		}
+	case len(id) >= 5 && string(id[:5]) == "\x7fFLAC":
+		if !oggFLACStream(st, id) {
+			return nil, fmt.Errorf("ogg: bad FLAC header in stream %08x", st.serial)
+		}
+	default:
+		return nil, fmt.Errorf("ogg: skipping stream %08x, only Opus, Vorbis and FLAC are supported", st.serial)
+	}
+	if st.rate <= 0 {
+		return nil, fmt.Errorf("ogg: bad %s sample rate", st.format.Codec)
+	}
+	if st.format.SampleRate == 0 {
+		st.format.SampleRate = st.rate
+	}
+	return st, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// oggPageBytes builds a page with the packets laced into it
+func oggPageBytes(flags byte, granule int64, serial, seq uint32, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+		body = append(body, p...)
+	}
+	page := make([]byte, 27, 27+len(lacing)+len(body))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], serial)
+	binary.LittleEndian.PutUint32(page[18:], seq)
+	page[26] = byte(len(lacing))
+	page = append(page, lacing...)
+	page = append(page, body...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	return page
+}
+
+func TestOggCRC(t *testing.T) {
+	tests := []struct {
+		data []byte
+		crc  uint32
+	}{
+		{nil, 0},
+		{[]byte("123456789"), 0x89a1897f},
+	}
+	for _, tt := range tests {
+		if crc := oggCRC(tt.data); crc != tt.crc {
+			t.Errorf("oggCRC(%q) = %#x, want %#x", tt.data, crc, tt.crc)
+		}
+	}
+	// The checksum field of a page doesn't count
+	page := oggPageBytes(0x02, 0, 1, 0, []byte("OpusHead"))
+	crc := binary.LittleEndian.Uint32(page[22:])
+	binary.LittleEndian.PutUint32(page[22:], 0xdeadbeef)
+	if oggCRC(page) != crc {
+		t.Error("the checksum field changed the checksum")
+	}
+}
+
+func TestOggReadPage(t *testing.T) {
+	long := bytes.Repeat([]byte{'a'}, 600)
+	page1 := oggPageBytes(0x02, 0, 7, 0, []byte("OpusHead........"))
+	page2 := oggPageBytes(0, 960, 7, 1, long, []byte("short"))
+	corrupt := append([]byte(nil), page2...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	version := append([]byte(nil), page1...)
+	version[4] = 1
+
+	tests := []struct {
+		name    string
+		in      [][]byte
+		pages   [][]byte
+		skipped []int
+		err     error
+	}{
+		{"pages back to back", [][]byte{page1, page2}, [][]byte{page1, page2}, []int{0, 0}, io.EOF},
+		{"garbage first", [][]byte{[]byte("junk"), page1}, [][]byte{page1}, []int{4}, io.EOF},
+		{"capture pattern in garbage", [][]byte{[]byte("OggS\x00xx"), page1}, [][]byte{page1}, []int{7}, io.EOF},
+		{"bad checksum", [][]byte{corrupt, page1}, [][]byte{page1}, []int{len(corrupt)}, io.EOF},
+		{"unknown version", [][]byte{version, page2}, [][]byte{page2}, []int{len(version)}, io.EOF},
+		{"cut short", [][]byte{page1, page2[:40]}, [][]byte{page1}, []int{0}, io.EOF},
+	}
+	for _, tt := range tests {
+		d := newOggDecoder(bytes.NewReader(bytes.Join(tt.in, nil)))
+		for i, want := range tt.pages {
+			page, skipped, err := d.readPage()
+			if err != nil {
+				t.Fatalf("%s: page %d: %v", tt.name, i, err)
+			}
+			if !bytes.Equal(page, want) || skipped != tt.skipped[i] {
+				t.Errorf("%s: page %d: %d bytes after skipping %d, want %d after %d", tt.name, i,
+					len(page), skipped, len(want), tt.skipped[i])
+			}
+		}
+		if _, _, err := d.readPage(); err != tt.err {
+			t.Errorf("%s: err %v at the end, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestOggPage(t *testing.T) {
+	long := bytes.Repeat([]byte{'a'}, 510)
+	p := oggPage(oggPageBytes(0x02, 123456789012, 42, 3, long, []byte("x"), nil))
+	if !p.bos() || p.granule() != 123456789012 || p.serial() != 42 {
+		t.Errorf("bos %v, granule %d, serial %d", p.bos(), p.granule(), p.serial())
+	}
+	// 510 bytes lace as 255, 255, 0
+	if n := len(p.segments()); n != 5 {
+		t.Errorf("%d segments, want 5", n)
+	}
+	if n := p.packetEnds(); n != 3 {
+		t.Errorf("%d packets end on the page, want 3", n)
+	}
+	if n := len(p.body()); n != 511 {
+		t.Errorf("body of %d bytes, want 511", n)
+	}
+}
+
+// opusHeadPages builds the two header pages of an Opus stream
+func opusHeadPages(serial uint32) []byte {
+	id := []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\x00\x00\x00")
+	return append(oggPageBytes(0x02, 0, serial, 0, id), oggPageBytes(0, 0, serial, 1, []byte("OpusTags"))...)
+}
+
+func TestOggNext(t *testing.T) {
+	hour := int64(3600 * 48000)
+	var in bytes.Buffer
+	// Joined an hour in, like a relay of a running mount
+	in.Write(opusHeadPages(7))
+	in.Write(oggPageBytes(0, hour, 7, 2, []byte("a")))
+	in.Write(oggPageBytes(0, hour+960, 7, 3, []byte("b")))
+	// A page no packet ends on
+	in.Write(oggPageBytes(0, -1, 7, 4, bytes.Repeat([]byte{'c'}, 255)))
+	in.Write(oggPageBytes(0, hour+3*960, 7, 5, []byte("d")))
+	// A chained stream that starts over, after a page with no granule
+	in.Write(opusHeadPages(8))
+	in.Write(oggPageBytes(0, -1, 8, 2, bytes.Repeat([]byte{'e'}, 255)))
+	in.Write(oggPageBytes(0, 960, 8, 3, []byte("f")))
+	in.Write(oggPageBytes(0, 2*960, 8, 4, []byte("g")))
+
+	d := newOggDecoder(&in)
+	want := []time.Duration{0, 20 * time.Millisecond, 0, 40 * time.Millisecond, 0, 0, 20 * time.Millisecond}
+	for i, dur := range want {
+		f, err := d.next()
+		if err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+		if f.dur != dur {
+			t.Errorf("page %d: %v, want %v", i, f.dur, dur)
+		}
+		if f.format.Codec != "Opus" || len(f.head) == 0 {
+			t.Errorf("page %d: %v with %d bytes of headers", i, f.format, len(f.head))
+		}
+	}
+	if _, err := d.next(); err != io.EOF {
+		t.Errorf("err %v at the end, want %v", err, io.EOF)
+	}
+}
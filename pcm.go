@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// pcmFormat is the layout of raw PCM, little endian and interleaved
+type pcmFormat struct {
+	rate     int
+	channels int
+	bits     int
+}
+
+func (p pcmFormat) blockAlign() int {
+	return p.channels * ((p.bits + 7) / 8)
+}
+
+func (p pcmFormat) audioFormat() audioFormat {
+	return audioFormat{
+		Codec:      fmt.Sprintf("PCM %dbit", p.bits),
+		SampleRate: p.rate,
+		Channels:   p.channels,
+	}
+}
+
+// wavHeader is the header of a WAV file that never ends,
+// both the RIFF and the data chunk are as long as they can be
+func (p pcmFormat) wavHeader() []byte {
+	h := make([]byte, 44)
+	le := binary.LittleEndian
+	copy(h, "RIFF")
+	le.PutUint32(h[4:], 0xffffffff)
+	copy(h[8:], "WAVEfmt ")
+	le.PutUint32(h[16:], 16)
+	le.PutUint16(h[20:], 1)
+	le.PutUint16(h[22:], uint16(p.channels))
+	le.PutUint32(h[24:], uint32(p.rate))
+	le.PutUint32(h[28:], uint32(p.rate*p.blockAlign()))
+	le.PutUint16(h[32:], uint16(p.blockAlign()))
+	le.PutUint16(h[34:], uint16(p.bits))
+	copy(h[36:], "data")
+	le.PutUint32(h[40:], 0xffffffff)
+	return h
+}
+
+// newPCMCodec is the pcm codec for a given layout, served as WAV
+func newPCMCodec(p pcmFormat) *codec {
+	return &codec{
+		name:        "pcm",
+		ext:         "wav",
+		contentType: "audio/wav",
+		head:        p.wavHeader(),
+		replaceHead: true,
+		newDecoder: func(r io.Reader) decoder {
+			return newPCMDecoder(r, p)
+		},
+	}
+}
+
+// pcmDecoder cuts raw PCM into 20ms frames and paces them by byte count.
+// An input that starts with a WAV header brings its own layout
+type pcmDecoder struct {
+	r       *bufio.Reader
+	pcm     pcmFormat
+	head    []byte
+	started bool
+}
+
+func newPCMDecoder(r io.Reader, p pcmFormat) *pcmDecoder {
+	return &pcmDecoder{
+		r:    bufio.NewReader(r),
+		pcm:  p,
+		head: p.wavHeader(),
+	}
+}
+
+// readWAVHeader skips the header of a WAV input, up to its data chunk
+func (d *pcmDecoder) readWAVHeader() error {
+	b, err := d.r.Peek(12)
+	if err != nil || string(b[:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		// Raw PCM, or too short to matter
+		return nil
+	}
+	d.r.Discard(12)
+	for {
+		var ch [8]byte
+		if _, err := io.ReadFull(d.r, ch[:]); err != nil {
+			return err
+		}
+		size := int(binary.LittleEndian.Uint32(ch[4:]))
+		switch string(ch[:4]) {
+		case "data":
+			return nil
+		case "fmt ":
+			if size < 16 {
+				return fmt.Errorf("wav: bad fmt chunk")
+			}
+			fc := make([]byte, size+size&1)
+			if _, err := io.ReadFull(d.r, fc); err != nil {
+				return err
+			}
+			le := binary.LittleEndian
+			// PCM, or the extensible format
+			if tag := le.Uint16(fc); tag != 1 && tag != 0xfffe {
+				return fmt.Errorf("wav: format %#x isn't PCM", tag)
+			}
+			p := pcmFormat{
+				rate:     int(le.Uint32(fc[4:])),
+				channels: int(le.Uint16(fc[2:])),
+				bits:     int(le.Uint16(fc[14:])),
+			}
+			if p.rate < 1 || p.channels < 1 || p.bits < 1 {
+				return fmt.Errorf("wav: bad fmt chunk")
+			}
+			if p != d.pcm {
+				log.Printf("wav: input is %s, not %s\n", p.audioFormat(), d.pcm.audioFormat())
+			}
+			d.pcm = p
+			d.head = p.wavHeader()
+		default:
+			if _, err := d.r.Discard(size + size&1); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (d *pcmDecoder) next() (frame, error) {
+	if !d.started {
+		d.started = true
+		if err := d.readWAVHeader(); err != nil {
+			return frame{}, err
+		}
+	}
+	align := d.pcm.blockAlign()
+	samples := d.pcm.rate / 50
+	if samples < 1 {
+		samples = 1
+	}
+	buf := make([]byte, samples*align)
+	n, err := io.ReadFull(d.r, buf)
+	// Whatever whole samples are left at the end
+	n -= n % align
+	if n == 0 {
+		if err == nil || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return frame{}, err
+	}
+	return frame{
+		data:   buf[:n],
+		dur:    time.Duration(n/align) * time.Second / time.Duration(d.pcm.rate),
+		format: d.pcm.audioFormat(),
+		head:   d.head,
+	}, nil
+}
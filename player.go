@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+var playerPage = template.Must(template.New("player").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 0; background: #222; color: #eee; }
+main { max-width: 32em; margin: 0 auto; padding: {{if .Embed}}0.5em{{else}}2em 1em{{end}}; }
+h1 { font-size: {{if .Embed}}1em{{else}}1.6em{{end}}; margin: 0 0 0.5em; }
+audio { width: 100%; }
+select { margin-bottom: 0.5em; }
+.title { font-size: 1.1em; margin: 0.5em 0; min-height: 1.3em; }
+.listeners { color: #999; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Name}}</h1>
+<select id="mount"{{if eq (len .Mounts) 1}} hidden{{end}}>
+{{range .Mounts}}<option value="{{.}}"{{if eq . $.Mount}} selected{{end}}>/{{.}}</option>
+{{end}}</select>
+<audio id="audio" controls preload="none" src="{{.Mount}}"></audio>
+<div class="title" id="title"></div>
+<div class="listeners" id="listeners"></div>
+</main>
+<script>
+var mount = document.getElementById("mount");
+var audio = document.getElementById("audio");
+mount.onchange = function() {
+	var playing = !audio.paused;
+	audio.src = mount.value;
+	if (playing) audio.play();
+	update();
+};
+function update() {
+	fetch("nowplaying.json").then(function(r) { return r.json(); }).then(function(np) {
+		np.mounts.forEach(function(m) {
+			if (m.mount != mount.value) return;
+			document.getElementById("title").textContent = m.title;
+			document.getElementById("listeners").textContent =
+				m.listeners + (m.listeners == 1 ? " listener" : " listeners");
+		});
+	}).catch(function() {});
+}
+update();
+setInterval(update, 5000);
+</script>
+</body>
+</html>
+`))
+
+// player serves a web page that plays the mounts,
+// and what they're playing for it to show
+type player struct {
+	Name   string
+	Genre  string
+	mounts *mountList
+}
+
+type nowPlaying struct {
+	Mount     string `json:"mount"`
+	Title     string `json:"title"`
+	Listeners int    `json:"listeners"`
+	Format    string `json:"format"`
+}
+
+func (p *player) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.page(w, r, false)
+}
+
+// embed is a compact player for an iframe
+func (p *player) embed(w http.ResponseWriter, r *http.Request) {
+	p.page(w, r, true)
+}
+
+func (p *player) page(w http.ResponseWriter, r *http.Request, embed bool) {
+	names := p.mounts.names()
+	if len(names) == 0 {
+		http.Error(w, "nothing is streaming", http.StatusNotFound)
+		return
+	}
+	mount := r.URL.Query().Get("mount")
+	if _, ok := p.mounts.get(mount); !ok {
+		mount = names[0]
+		for _, name := range names {
+			if name == "stream" {
+				mount = name
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := playerPage.Execute(w, struct {
+		Name   string
+		Mounts []string
+		Mount  string
+		Embed  bool
+	}{p.Name, names, mount, embed})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// nowPlaying lists the mounts with their titles and listeners
+func (p *player) nowPlaying(w http.ResponseWriter, r *http.Request) {
+	np := struct {
+		Name   string       `json:"name"`
+		Mounts []nowPlaying `json:"mounts"`
+	}{p.Name, []nowPlaying{}}
+	for _, name := range p.mounts.names() {
+		s, ok := p.mounts.get(name)
+		if !ok {
+			continue
+		}
+		np.Mounts = append(np.Mounts, nowPlaying{
+			Mount:     name,
+			Title:     s.getTitle(),
+			Listeners: s.listeners(),
+			Format:    s.getFormat().String(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(np)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tcolgate/mp3"
+)
+
+type track struct {
+	path  string
+	title string
+}
+
+// playlist plays the mp3 files of a directory or an M3U file in a loop,
+// handing only the frames to the read loop so tags never end up in the stream
+type playlist struct {
+	path    string
+	onTitle func(string)
+	tracks  []track
+	next    int
+	played  bool
+	file    *os.File
+	dec     *mp3.Decoder
+}
+
+func newPlaylist(path string, onTitle func(string)) *playlist {
+	return &playlist{
+		path:    path,
+		onTitle: onTitle,
+	}
+}
+
+// isPlaylist reports whether a mount input should be played as a playlist
+func isPlaylist(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u", ".m3u8":
+		return true
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// Decode reads the next audio frame, moving on to the next track at EOF
+func (p *playlist) Decode(v *mp3.Frame, skipped *int) error {
+	for {
+		if p.dec == nil {
+			if err := p.open(); err != nil {
+				return err
+			}
+		}
+		err := p.dec.Decode(v, skipped)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				log.Printf("%s: %v\n", p.file.Name(), err)
+			}
+			p.close()
+			continue
+		}
+		p.played = true
+		return nil
+	}
+}
+
+func (p *playlist) Close() error {
+	p.close()
+	return nil
+}
+
+func (p *playlist) close() {
+	if p.file != nil {
+		p.file.Close()
+	}
+	p.file = nil
+	p.dec = nil
+}
+
+// open opens the next playable track, reloading the list after the last one
+func (p *playlist) open() error {
+	for {
+		if p.next >= len(p.tracks) {
+			if len(p.tracks) > 0 && !p.played {
+				return errors.New("playlist: no playable tracks")
+			}
+			tracks, err := loadTracks(p.path)
+			if err != nil {
+				return err
+			}
+			if len(tracks) == 0 {
+				return errors.New("playlist: no tracks found")
+			}
+			p.tracks = tracks
+			p.next = 0
+			p.played = false
+		}
+		t := p.tracks[p.next]
+		p.next++
+		if err := p.openTrack(t); err != nil {
+			log.Println(err)
+			continue
+		}
+		return nil
+	}
+}
+
+// openTrack positions the decoder after any ID3v2 tag and stops it
+// before an ID3v1 tag, then announces the title
+func (p *playlist) openTrack(t track) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	size := fi.Size()
+	var v1 id3Tags
+	var hasV1 bool
+	if size >= 128 {
+		tail := make([]byte, 128)
+		if _, err := f.ReadAt(tail, size-128); err == nil {
+			if v1, hasV1 = readID3v1(tail); hasV1 {
+				size -= 128
+			}
+		}
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	v2, err := readID3v2(r)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", t.path, err)
+	}
+	title := t.title
+	if title == "" {
+		title = v2.String()
+	}
+	if title == "" && hasV1 {
+		title = v1.String()
+	}
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(t.path), filepath.Ext(t.path))
+	}
+	p.file = f
+	p.dec = mp3.NewDecoder(r)
+	log.Printf("Playing %s\n", t.path)
+	if p.onTitle != nil {
+		p.onTitle(title)
+	}
+	return nil
+}
+
+// loadTracks lists the mp3 files of a directory or the entries of an M3U file
+func loadTracks(path string) ([]track, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var tracks []track
+		for _, f := range files {
+			if f.IsDir() || strings.ToLower(filepath.Ext(f.Name())) != ".mp3" {
+				continue
+			}
+			tracks = append(tracks, track{path: filepath.Join(path, f.Name())})
+		}
+		sort.Slice(tracks, func(i, j int) bool {
+			return tracks[i].path < tracks[j].path
+		})
+		return tracks, nil
+	}
+	return loadM3U(path)
+}
+
+// loadM3U parses a plain or extended M3U file, relative
+// entries are relative to the M3U file itself
+func loadM3U(path string) ([]track, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tracks []track
+	var title string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			if i := strings.Index(line, ","); i >= 0 {
+				title = strings.TrimSpace(line[i+1:])
+			}
+		case strings.HasPrefix(line, "#"):
+		case strings.Contains(line, "://"):
+			log.Printf("playlist: skipping %s, only local files are supported\n", line)
+			title = ""
+		default:
+			if !filepath.IsAbs(line) {
+				line = filepath.Join(filepath.Dir(path), line)
+			}
+			tracks = append(tracks, track{path: line, title: title})
+			title = ""
+		}
+	}
+	return tracks, scanner.Err()
+}
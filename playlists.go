@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Playlist files of a mount, by extension
+var playlistTypes = map[string]string{
+	".m3u":  "audio/x-mpegurl",
+	".pls":  "audio/x-scpls",
+	".xspf": "application/xspf+xml",
+}
+
+// baseURL is the URL the request came in at without the path,
+// as the client sees it through a reverse proxy
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	// Only what the first proxy says counts
+	fwd := strings.Split(r.Header.Get("Forwarded"), ",")[0]
+	for _, f := range strings.Split(fwd, ";") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.Trim(kv[1], `"`)
+		switch strings.ToLower(kv[0]) {
+		case "proto":
+			scheme = v
+		case "host":
+			host = v
+		}
+	}
+	if v := r.Header.Get("X-Forwarded-Proto"); v != "" {
+		scheme = strings.TrimSpace(strings.Split(v, ",")[0])
+	}
+	if v := r.Header.Get("X-Forwarded-Host"); v != "" {
+		host = strings.TrimSpace(strings.Split(v, ",")[0])
+	}
+	prefix := strings.TrimSuffix(r.Header.Get("X-Forwarded-Prefix"), "/")
+	return scheme + "://" + host + prefix
+}
+
+type xspfTrack struct {
+	Location   string `xml:"location"`
+	Title      string `xml:"title"`
+	Annotation string `xml:"annotation,omitempty"`
+	Info       string `xml:"info"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+// playlist serves a playlist file with the URL of a mount in it
+func (p *player) playlist(w http.ResponseWriter, r *http.Request, s *streamer, ext string) {
+	base := baseURL(r)
+	url := base + "/" + s.Name
+	var b bytes.Buffer
+	switch ext {
+	case ".m3u":
+		b.WriteString("#EXTM3U\n")
+		if p.Genre != "" {
+			fmt.Fprintf(&b, "#EXTGENRE:%s\n", p.Genre)
+		}
+		fmt.Fprintf(&b, "#EXTINF:-1,%s\n%s\n", p.Name, url)
+	case ".pls":
+		b.WriteString("[playlist]\nNumberOfEntries=1\n")
+		fmt.Fprintf(&b, "File1=%s\nTitle1=%s\nLength1=-1\n", url, p.Name)
+		if p.Genre != "" {
+			fmt.Fprintf(&b, "Genre1=%s\n", p.Genre)
+		}
+		b.WriteString("Version=2\n")
+	case ".xspf":
+		b.WriteString(xml.Header)
+		enc := xml.NewEncoder(&b)
+		enc.Indent("", "  ")
+		enc.Encode(xspfPlaylist{
+			Version: 1,
+			Title:   p.Name,
+			Tracks: []xspfTrack{{
+				Location:   url,
+				Title:      p.Name,
+				Annotation: p.Genre,
+				Info:       base + "/",
+			}},
+		})
+		b.WriteString("\n")
+	}
+	w.Header().Set("Content-Type", playlistTypes[ext])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", s.Name+ext))
+	b.WriteTo(w)
+}
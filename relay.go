@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long an upstream can send nothing before it's reconnected
+const relayIdle = 30 * time.Second
+
+// relayClient talks to upstream stations, including old shoutcast
+// servers that answer with "ICY 200 OK" instead of a http status line
+var relayClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return newIcyConn(conn), nil
+		},
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// icyConn rewrites a leading "ICY" status line to HTTP/1.0, and gives
+// up on reads after relayIdle so a stalled upstream ends in an error
+type icyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	checked bool
+}
+
+func newIcyConn(conn net.Conn) *icyConn {
+	return &icyConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (c *icyConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(relayIdle))
+	if !c.checked {
+		c.checked = true
+		head, err := c.r.Peek(4)
+		if err == nil && string(head) == "ICY " {
+			c.r.Discard(3)
+			n := copy(p, "HTTP/1.0")
+			return n, nil
+		}
+	}
+	return c.r.Read(p)
+}
+
+// openURL fetches an upstream stream, asking for icy metadata
+// which is then stripped from the audio and passed to onTitle
+func openURL(url string, onTitle func(string)) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Icy-MetaData", "1")
+	req.Header.Set("User-Agent", "dumb-mp3-streamer")
+	resp, err := relayClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	metaint, err := strconv.Atoi(resp.Header.Get("icy-metaint"))
+	if err != nil || metaint <= 0 {
+		return resp.Body, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{newIcyReader(resp.Body, metaint, onTitle), resp.Body}, nil
+}
+
+func isURL(spec string) bool {
+	return strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://")
+}
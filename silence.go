@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/tcolgate/mp3"
+)
+
+// makeSilence builds a silent frame in the format of the given header.
+// mp3.MakeSilence only comes in one format, but a frame with zeroed side
+// info and no main data decodes to silence for any of them
+func makeSilence(head mp3.FrameHeader) (frame, error) {
+	// No CRC, no padding, the decoder reads as much of the zeroes
+	// as the header says the frame is long
+	b := make([]byte, 4096)
+	copy(b, head)
+	b[1] |= 0x01
+	b[2] &^= 0x02
+	f := new(mp3.Frame)
+	skipped := 0
+	if err := mp3.NewDecoder(bytes.NewReader(b)).Decode(f, &skipped); err != nil {
+		return frame{}, err
+	}
+	return newMP3Frame(f), nil
+}
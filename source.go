@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// source accepts icecast SOURCE and PUT requests from remote encoders
+// and broadcasts the request body as a new mount
+type source struct {
+	User   string
+	Pass   string
+	conf   *streamConfig
+	mounts *mountList
+}
+
+func (src *source) auth(w http.ResponseWriter, r *http.Request) bool {
+	if src.Pass == "" {
+		http.Error(w, "source connections disabled", http.StatusForbidden)
+		return false
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(user), []byte(src.User)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pass), []byte(src.Pass)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dumb-mp3-streamer source"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (src *source) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !src.auth(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if err := validMount(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := src.mounts.reserve(name); err != nil {
+		http.Error(w, "mountpoint in use", http.StatusForbidden)
+		return
+	}
+	defer src.mounts.del(name)
+	input, closer, err := src.body(w, r)
+	if err != nil {
+		log.Printf("%s: %v\n", name, err)
+		return
+	}
+	defer closer.Close()
+
+	log.Printf("%s: source connected from %s\n", name, r.RemoteAddr)
+	str := src.conf.newStreamer(name, input)
+	if cd, ok := codecByType(r.Header.Get("Content-Type")); ok {
+		str.Codec = cd
+	}
+	if err := str.init(); err != nil {
+		log.Printf("%s: %v\n", name, err)
+		return
+	}
+	if err := src.mounts.add(str); err != nil {
+		log.Println(err)
+		return
+	}
+	str.readLoop()
+	log.Printf("%s: source disconnected\n", name)
+}
+
+// body returns the audio stream of a source request. Legacy SOURCE
+// requests and PUT without a length stream until the connection closes,
+// which net/http treats as an empty body, so those get hijacked
+func (src *source) body(w http.ResponseWriter, r *http.Request) (io.Reader, io.Closer, error) {
+	if r.Method != "SOURCE" && (r.ContentLength > 0 || len(r.TransferEncoding) > 0) {
+		return r.Body, r.Body, nil
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot stream request body", http.StatusInternalServerError)
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	resp := "HTTP/1.0 200 OK\r\n\r\n"
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		resp = "HTTP/1.1 100 Continue\r\n\r\n"
+	}
+	if _, err := io.WriteString(conn, resp); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return bufrw.Reader, conn, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Time formats of the Icecast status
+const (
+	icecastTime    = "Mon, 02 Jan 2006 15:04:05 -0700"
+	icecastISOTime = "2006-01-02T15:04:05-0700"
+)
+
+// sentWriter counts the bytes that go out to a client,
+// for its session too once it has one
+type sentWriter struct {
+	w io.Writer
+	s *streamer
+	c *session
+}
+
+func (sw *sentWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.s.sent.Add(uint64(n))
+	if sw.c != nil {
+		sw.c.sent.Add(uint64(n))
+	}
+	return n, err
+}
+
+// addShifted adds the session of a time-shifted listener,
+// they aren't clients of the live stream
+func (s *streamer) addShifted(id uint64, c *session) {
+	s.Lock()
+	defer s.Unlock()
+	s.shifted[id] = c
+	s.count.connections++
+	s.updatePeak()
+}
+
+func (s *streamer) delShifted(id uint64) {
+	s.Lock()
+	defer s.Unlock()
+	// Killed ones are gone already
+	if c, ok := s.shifted[id]; ok {
+		close(c.ch)
+		delete(s.shifted, id)
+	}
+}
+
+// updatePeak keeps the peak listener count, the lock must be held
+func (s *streamer) updatePeak() {
+	if n := len(s.clients) + len(s.shifted); n > s.peak {
+		s.peak = n
+	}
+}
+
+// setBitrate keeps the bitrate of the last chunk read, that of the mp3
+// frame header if there is one
+func (s *streamer) setBitrate(buf []byte, dur time.Duration) {
+	var kbps int
+	if s.last != nil {
+		if br := s.last.BitRate(); br > 0 {
+			kbps = int(br) / 1000
+		}
+	} else if dur > 0 {
+		kbps = int(int64(len(buf)) * 8 * int64(time.Second) / int64(dur) / 1000)
+	}
+	s.Lock()
+	s.bitrate = kbps
+	s.Unlock()
+}
+
+// mountStats is what /status reports about a mount
+type mountStats struct {
+	Mount        string    `json:"mount"`
+	Listeners    int       `json:"listeners"`
+	ListenerPeak int       `json:"listener_peak"`
+	StreamStart  time.Time `json:"stream_start"`
+	Bitrate      int       `json:"bitrate"`
+	SampleRate   int       `json:"samplerate"`
+	Channels     int       `json:"channels"`
+	Format       string    `json:"format"`
+	ContentType  string    `json:"content_type"`
+	Title        string    `json:"title"`
+	BytesSent    uint64    `json:"bytes_sent"`
+	// Milliseconds the input has run ahead of real time
+	Drift int64 `json:"drift_ms"`
+}
+
+func (s *streamer) stats() mountStats {
+	s.RLock()
+	defer s.RUnlock()
+	return mountStats{
+		Mount:        s.Name,
+		Listeners:    len(s.clients) + len(s.shifted),
+		ListenerPeak: s.peak,
+		StreamStart:  s.started,
+		Bitrate:      s.bitrate,
+		SampleRate:   s.format.SampleRate,
+		Channels:     s.format.Channels,
+		Format:       s.format.String(),
+		ContentType:  s.Codec.contentType,
+		Title:        s.title,
+		BytesSent:    s.sent.Load(),
+		Drift:        int64(s.drift / time.Millisecond),
+	}
+}
+
+// status reports on the server and its mounts, natively and like Icecast does
+type status struct {
+	*player
+	started time.Time
+}
+
+func (st *status) mountStats() []mountStats {
+	list := []mountStats{}
+	for _, name := range st.mounts.names() {
+		if s, ok := st.mounts.get(name); ok {
+			list = append(list, s.stats())
+		}
+	}
+	return list
+}
+
+// native serves /status
+func (st *status) native(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(struct {
+		Name        string       `json:"name"`
+		Genre       string       `json:"genre"`
+		ServerStart time.Time    `json:"server_start"`
+		Mounts      []mountStats `json:"mounts"`
+	}{st.Name, st.Genre, st.started, st.mountStats()})
+}
+
+type icecastSource struct {
+	AudioInfo          string      `json:"audio_info"`
+	Bitrate            int         `json:"bitrate"`
+	Channels           int         `json:"channels"`
+	Genre              string      `json:"genre"`
+	ListenerPeak       int         `json:"listener_peak"`
+	Listeners          int         `json:"listeners"`
+	ListenURL          string      `json:"listenurl"`
+	SampleRate         int         `json:"samplerate"`
+	ServerDescription  string      `json:"server_description"`
+	ServerName         string      `json:"server_name"`
+	ServerType         string      `json:"server_type"`
+	ServerURL          string      `json:"server_url"`
+	StreamStart        string      `json:"stream_start"`
+	StreamStartISO8601 string      `json:"stream_start_iso8601"`
+	Title              string      `json:"title"`
+	TotalBytesSent     uint64      `json:"total_bytes_sent"`
+	Dummy              interface{} `json:"dummy"`
+}
+
+// icecast serves /status-json.xsl, Icecast has a single source
+// as an object and more as a list
+func (st *status) icecast(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	var sources []icecastSource
+	for _, m := range st.mountStats() {
+		sources = append(sources, icecastSource{
+			AudioInfo:          fmt.Sprintf("channels=%d;samplerate=%d;bitrate=%d", m.Channels, m.SampleRate, m.Bitrate),
+			Bitrate:            m.Bitrate,
+			Channels:           m.Channels,
+			Genre:              st.Genre,
+			ListenerPeak:       m.ListenerPeak,
+			Listeners:          m.Listeners,
+			ListenURL:          base + "/" + m.Mount,
+			SampleRate:         m.SampleRate,
+			ServerDescription:  st.Name,
+			ServerName:         st.Name,
+			ServerType:         m.ContentType,
+			ServerURL:          base + "/",
+			StreamStart:        m.StreamStart.Format(icecastTime),
+			StreamStartISO8601: m.StreamStart.Format(icecastISOTime),
+			Title:              m.Title,
+			TotalBytesSent:     m.BytesSent,
+		})
+	}
+	stats := map[string]interface{}{
+		"admin":                "",
+		"host":                 r.Host,
+		"location":             "",
+		"server_id":            "dumb-mp3-streamer",
+		"server_start":         st.started.Format(icecastTime),
+		"server_start_iso8601": st.started.Format(icecastISOTime),
+	}
+	switch len(sources) {
+	case 0:
+	case 1:
+		stats["source"] = sources[0]
+	default:
+		stats["source"] = sources
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{"icestats": stats})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Length of a time-shift segment file
+const segmentDur = time.Minute
+
+// A record is a chunk on disk: its duration in nanoseconds, its length and the data
+const recordHead = 12
+
+// errLive is returned by a shiftReader that has caught up with the stream
+var errLive = errors.New("timeshift: caught up with the stream")
+
+// segment is a file of chunks. Times are stream time, the total duration
+// of the audio recorded before, so gaps in the input don't count
+type segment struct {
+	start time.Duration
+	dur   time.Duration
+	path  string
+	// Wall clock time of the start
+	at time.Time
+}
+
+// timeShift keeps the chunks of a stream on disk for a while,
+// a segment file a minute, so listeners can start in the past
+type timeShift struct {
+	sync.RWMutex
+	dir  string
+	keep time.Duration
+	segs []*segment
+	end  time.Duration
+	file *os.File
+	// Only the first write error gets logged
+	failed bool
+}
+
+// newTimeShift starts over in dir, leftover segments are from another run
+func newTimeShift(dir string, keep time.Duration) (*timeShift, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".seg") {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+	return &timeShift{
+		dir:  dir,
+		keep: keep,
+	}, nil
+}
+
+// write appends a chunk
+func (t *timeShift) write(c chunk) {
+	t.Lock()
+	defer t.Unlock()
+	if err := t.append(c); err != nil && !t.failed {
+		t.failed = true
+		log.Printf("timeshift: %v\n", err)
+	}
+}
+
+func (t *timeShift) append(c chunk) error {
+	var cur *segment
+	if len(t.segs) > 0 {
+		cur = t.segs[len(t.segs)-1]
+	}
+	if cur == nil || cur.dur >= segmentDur || t.file == nil {
+		if t.file != nil {
+			t.file.Close()
+			t.file = nil
+		}
+		now := time.Now()
+		cur = &segment{
+			start: t.end,
+			path:  filepath.Join(t.dir, fmt.Sprintf("%d.seg", now.UnixNano())),
+			at:    now,
+		}
+		f, err := os.Create(cur.path)
+		if err != nil {
+			return err
+		}
+		t.file = f
+		t.segs = append(t.segs, cur)
+		t.expire()
+	}
+	rec := make([]byte, recordHead+len(c.data))
+	binary.BigEndian.PutUint64(rec, uint64(c.dur))
+	binary.BigEndian.PutUint32(rec[8:], uint32(len(c.data)))
+	copy(rec[recordHead:], c.data)
+	if _, err := t.file.Write(rec); err != nil {
+		return err
+	}
+	cur.dur += c.dur
+	t.end += c.dur
+	return nil
+}
+
+// expire removes the segments that ended more than keep ago
+func (t *timeShift) expire() {
+	for len(t.segs) > 1 && t.end-(t.segs[0].start+t.segs[0].dur) > t.keep {
+		os.Remove(t.segs[0].path)
+		t.segs = t.segs[1:]
+	}
+}
+
+// after returns the segment that follows seg, nil if seg is still being
+// written. Readers left behind by expired segments go on with the oldest
+func (t *timeShift) after(seg *segment) *segment {
+	t.RLock()
+	defer t.RUnlock()
+	for i, s := range t.segs {
+		if s == seg {
+			if i+1 < len(t.segs) {
+				return t.segs[i+1]
+			}
+			return nil
+		}
+	}
+	if len(t.segs) > 0 && t.segs[0].start > seg.start {
+		return t.segs[0]
+	}
+	return nil
+}
+
+// shiftReader reads the chunks of a timeShift from some point in time on
+type shiftReader struct {
+	t   *timeShift
+	seg *segment
+	f   *os.File
+	// The segment has a successor, so nothing more gets written to it
+	done bool
+}
+
+// reader starts reading at the chunk playing offset back from the end,
+// or at the oldest chunk kept if that's already gone
+func (t *timeShift) reader(offset time.Duration) (*shiftReader, error) {
+	t.RLock()
+	if len(t.segs) == 0 {
+		t.RUnlock()
+		return nil, errLive
+	}
+	at := t.end + offset
+	seg := t.segs[0]
+	for _, s := range t.segs {
+		if s.start > at {
+			break
+		}
+		seg = s
+	}
+	t.RUnlock()
+	r := &shiftReader{t: t}
+	if err := r.open(seg); err != nil {
+		return nil, err
+	}
+	// Skip the chunks that are over by then
+	pos := seg.start
+	for {
+		c, n, err := r.read()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The end of what's there, next goes on from here
+			_, err = r.f.Seek(-int64(n), io.SeekCurrent)
+		} else if err == nil && pos+c.dur > at {
+			// Still playing at that time
+			_, err = r.f.Seek(-int64(recordHead+len(c.data)), io.SeekCurrent)
+		} else if err == nil {
+			pos += c.dur
+			continue
+		}
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+func (r *shiftReader) open(seg *segment) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.seg = seg
+	r.f = f
+	r.done = false
+	return nil
+}
+
+// next returns the next chunk, errLive if there's none yet
+func (r *shiftReader) next() (chunk, error) {
+	for {
+		c, n, err := r.read()
+		if err == nil {
+			return c, nil
+		}
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return chunk{}, err
+		}
+		// End of the segment, or a record that's only partly written
+		if _, err := r.f.Seek(-int64(n), io.SeekCurrent); err != nil {
+			return chunk{}, err
+		}
+		next := r.t.after(r.seg)
+		if next == nil {
+			return chunk{}, errLive
+		}
+		if r.done {
+			if err := r.open(next); err != nil {
+				return chunk{}, err
+			}
+			continue
+		}
+		// Whatever was written before the next segment started is in the file now
+		r.done = true
+	}
+}
+
+// read reads a record, returning how much it read if it failed
+func (r *shiftReader) read() (chunk, int, error) {
+	var h [recordHead]byte
+	n, err := io.ReadFull(r.f, h[:])
+	if err != nil {
+		return chunk{}, n, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(h[8:]))
+	m, err := io.ReadFull(r.f, data)
+	if err != nil {
+		return chunk{}, n + m, err
+	}
+	return chunk{data, time.Duration(binary.BigEndian.Uint64(h[:]))}, 0, nil
+}
+
+func (r *shiftReader) Close() error {
+	return r.f.Close()
+}
+
+// playShift plays the stream from the offset of the session back in time
+// on, in real time after a burst as long as the live one. The offset
+// counts from where the burst of a live listener would start
+func (s *streamer) playShift(r *http.Request, id uint64, c *session, buffw *bufio.Writer, out io.Writer) {
+	rd, err := s.shift.reader(c.offset - s.BuffSize)
+	if err != nil {
+		if err != errLive {
+			log.Printf("%s: %v\n", s.Name, err)
+		}
+		return
+	}
+	defer rd.Close()
+	s.addShifted(id, c)
+	defer s.delShifted(id)
+	s.RLock()
+	head := s.head
+	s.RUnlock()
+	if _, err := out.Write(head); err != nil {
+		return
+	}
+	// wait reports whether the listener is still there after d
+	wait := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-r.Context().Done():
+		case <-c.ch:
+			// Killed
+		case <-s.Stop:
+			buffw.Flush()
+		}
+		return false
+	}
+	var clock frameClock
+	for {
+		chunk, err := rd.next()
+		if err == errLive {
+			// Caught up with the stream, the next chunk is on its way
+			if !wait(s.ReadSize / 10) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("%s: %v\n", s.Name, err)
+			return
+		}
+		if _, err := out.Write(chunk.data); err != nil {
+			return
+		}
+		if ahead := clock.add(chunk.dur) - s.BuffSize; ahead > 0 && !wait(ahead) {
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testShift is a time-shift in a temporary directory
+func testShift(t *testing.T, keep time.Duration) (*timeShift, func()) {
+	dir, err := ioutil.TempDir("", "timeshift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := newTimeShift(dir, keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts, func() {
+		if ts.file != nil {
+			ts.file.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// writeChunks writes chunks named c000 on, from first, dur each
+func writeChunks(ts *timeShift, first, n int, dur time.Duration) {
+	for i := first; i < first+n; i++ {
+		ts.write(chunk{[]byte(fmt.Sprintf("c%03d", i)), dur})
+	}
+}
+
+// readChunks reads chunks up to errLive and names them
+func readChunks(t *testing.T, r *shiftReader) string {
+	var names []string
+	for {
+		c, err := r.next()
+		if err == errLive {
+			return strings.Join(names, " ")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, string(c.data))
+	}
+}
+
+func TestShiftReaderOffset(t *testing.T) {
+	ts, done := testShift(t, time.Hour)
+	defer done()
+	// 3 chunks a segment, 3 segments
+	writeChunks(ts, 0, 9, 20*time.Second)
+	if len(ts.segs) != 3 {
+		t.Fatalf("%d segments, want 3", len(ts.segs))
+	}
+	tests := []struct {
+		offset time.Duration
+		chunks string
+	}{
+		{0, ""},
+		{-time.Second, "c008"},
+		{-20 * time.Second, "c008"},
+		{-21 * time.Second, "c007 c008"},
+		{-100 * time.Second, "c004 c005 c006 c007 c008"},
+		{-120 * time.Second, "c003 c004 c005 c006 c007 c008"},
+		{-180 * time.Second, "c000 c001 c002 c003 c004 c005 c006 c007 c008"},
+		// Further back than what's kept starts with the oldest
+		{-time.Hour, "c000 c001 c002 c003 c004 c005 c006 c007 c008"},
+	}
+	for _, tt := range tests {
+		r, err := ts.reader(tt.offset)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.offset, err)
+		}
+		if got := readChunks(t, r); got != tt.chunks {
+			t.Errorf("%v: %s, want %s", tt.offset, got, tt.chunks)
+		}
+		r.Close()
+	}
+}
+
+func TestShiftReaderLive(t *testing.T) {
+	ts, done := testShift(t, time.Hour)
+	defer done()
+	if _, err := ts.reader(-time.Minute); err != errLive {
+		t.Fatalf("err %v with nothing kept, want %v", err, errLive)
+	}
+	writeChunks(ts, 0, 1, 20*time.Second)
+	r, err := ts.reader(-time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got := readChunks(t, r); got != "c000" {
+		t.Fatalf("%s, want c000", got)
+	}
+
+	// A record the reader gets to while it's written
+	rec := make([]byte, recordHead+4)
+	binary.BigEndian.PutUint64(rec, uint64(20*time.Second))
+	binary.BigEndian.PutUint32(rec[8:], 4)
+	copy(rec[recordHead:], "c001")
+	for _, part := range [][]byte{rec[:5], rec[5:14], rec[14:]} {
+		if got := readChunks(t, r); got != "" {
+			t.Fatalf("%s of a half written record", got)
+		}
+		ts.file.Write(part)
+	}
+	if got := readChunks(t, r); got != "c001" {
+		t.Fatalf("%s, want c001", got)
+	}
+
+	// Chunks written meanwhile, into the next segment too
+	writeChunks(ts, 2, 4, 20*time.Second)
+	if len(ts.segs) != 2 {
+		t.Fatalf("%d segments, want 2", len(ts.segs))
+	}
+	if got := readChunks(t, r); got != "c002 c003 c004 c005" {
+		t.Errorf("%s, want c002 c003 c004 c005", got)
+	}
+}
+
+func TestShiftReaderExpired(t *testing.T) {
+	ts, done := testShift(t, time.Minute)
+	defer done()
+	writeChunks(ts, 0, 3, 20*time.Second)
+	r, err := ts.reader(-time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if c, err := r.next(); err != nil || string(c.data) != "c000" {
+		t.Fatalf("%s %v, want c000", c.data, err)
+	}
+	// The segment being read and the one after it expire meanwhile
+	writeChunks(ts, 3, 12, 20*time.Second)
+	if ts.segs[0].start != 120*time.Second {
+		t.Fatalf("oldest segment starts at %v, want 2m0s", ts.segs[0].start)
+	}
+	if _, err := os.Stat(r.seg.path); !os.IsNotExist(err) {
+		t.Fatalf("segment being read is still there: %v", err)
+	}
+	want := "c001 c002 c006 c007 c008 c009 c010 c011 c012 c013 c014"
+	if got := readChunks(t, r); got != want {
+		t.Errorf("%s, want %s", got, want)
+	}
+}
+
+// Time-shifted listeners start a burst earlier than the offset
+func TestPlayShift(t *testing.T) {
+	ts, done := testShift(t, time.Hour)
+	defer done()
+	writeChunks(ts, 0, 10, time.Second)
+	s := &streamer{
+		Name:      "stream",
+		BuffSize:  2 * time.Second,
+		ReadSize:  time.Second,
+		WriteBuff: 512,
+		Codec:     codecs["mp3"],
+		head:      []byte("head"),
+		shift:     ts,
+		clients:   make(map[uint64]*session),
+		shifted:   make(map[uint64]*session),
+		Stop:      make(chan bool),
+	}
+	time.AfterFunc(200*time.Millisecond, func() { close(s.Stop) })
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream?offset=-5", nil))
+	// c003 plays 7 seconds back, the burst goes on until it's 2 seconds
+	// ahead of real time and the rest waits
+	if got := w.Body.String(); got != "headc003c004c005c006" {
+		t.Errorf("%q", got)
+	}
+	if s.listeners() != 0 || s.count.connections != 1 {
+		t.Errorf("%d listeners after %d connections", s.listeners(), s.count.connections)
+	}
+}
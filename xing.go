@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+
+	"github.com/tcolgate/mp3"
+)
+
+// Samples of delay the mp3 decoder itself adds on top of the encoder delay
+const decoderDelay = 529
+
+// frameBytes returns the raw bytes of a decoded frame
+func frameBytes(f *mp3.Frame) []byte {
+	b, _ := ioutil.ReadAll(f.Reader())
+	return b
+}
+
+// xingInfo is what a Xing/Info or VBRI header frame tells about its track
+type xingInfo struct {
+	// Audio frames in the track, 0 if unknown
+	frames int
+	// Encoder delay and padding in samples, from the LAME extension
+	delay   int
+	padding int
+}
+
+// parseXing parses a Xing/Info or VBRI header frame. Encoders put one
+// at the start of a file and it decodes as a frame of garbage
+func parseXing(f *mp3.Frame) (info xingInfo, ok bool) {
+	b := frameBytes(f)
+	side, err := f.SideInfoLength()
+	if err != nil {
+		return
+	}
+	off := 4 + side
+	if f.Header().Protection() {
+		off += 2
+	}
+	if len(b) >= 40 && string(b[36:40]) == "VBRI" {
+		if len(b) >= 54 {
+			info.frames = bigEndian(b[50:54])
+		}
+		return info, true
+	}
+	if len(b) < off+8 {
+		return
+	}
+	switch string(b[off : off+4]) {
+	case "Xing", "Info":
+	default:
+		return
+	}
+	flags := bigEndian(b[off+4 : off+8])
+	pos := off + 8
+	if flags&0x1 != 0 && len(b) >= pos+4 {
+		info.frames = bigEndian(b[pos : pos+4])
+		pos += 4
+	}
+	if flags&0x2 != 0 {
+		pos += 4
+	}
+	if flags&0x4 != 0 {
+		pos += 100
+	}
+	if flags&0x8 != 0 {
+		pos += 4
+	}
+	// The LAME extension, also written by ffmpeg, starts with the encoder
+	// version and has the delay and padding as two 12 bit values at 21
+	if len(b) >= pos+24 {
+		switch string(b[pos : pos+4]) {
+		case "LAME", "Lavc", "Lavf", "GOGO":
+			dp := b[pos+21 : pos+24]
+			info.delay = int(dp[0])<<4 | int(dp[1])>>4
+			info.padding = int(dp[1]&0x0f)<<8 | int(dp[2])
+		}
+	}
+	return info, true
+}
+
+// gapless drops encoder header frames from the input, along with the
+// whole frames of encoder delay and padding they announce at the edges
+// of their track, so concatenated tracks join without gaps and clicks
+type gapless struct {
+	// Frames of the current track and how far into it we are
+	frames int
+	pos    int
+	// Frames to drop at the start and at the end of the track
+	head int
+	tail int
+}
+
+// keep reports whether a frame should be broadcast
+func (g *gapless) keep(f *mp3.Frame) bool {
+	if info, ok := parseXing(f); ok {
+		spf := f.Samples()
+		*g = gapless{
+			frames: info.frames,
+			head:   (info.delay + decoderDelay) / spf,
+		}
+		if info.padding > decoderDelay {
+			g.tail = (info.padding - decoderDelay) / spf
+		}
+		return false
+	}
+	g.pos++
+	if g.pos <= g.head {
+		return false
+	}
+	if g.frames > 0 && g.pos <= g.frames && g.pos > g.frames-g.tail {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/tcolgate/mp3"
+)
+
+// mp3FrameBytes builds a 128 kbps 44.1 kHz MPEG1 layer 3 frame, stereo
+// or mono, with data from the end of the side info on
+func mp3FrameBytes(mono bool, data []byte) []byte {
+	b := make([]byte, 417)
+	copy(b, []byte{0xff, 0xfb, 0x90, 0x00})
+	side := 32
+	if mono {
+		b[3] = 0xc0
+		side = 17
+	}
+	copy(b[4+side:], data)
+	return b
+}
+
+// xingTag builds a Xing/Info tag with the fields flags has, and a LAME
+// style extension of the encoder if it's given
+func xingTag(id string, flags uint32, frames int, encoder string, delay, padding int) []byte {
+	b := []byte(id)
+	b = binary.BigEndian.AppendUint32(b, flags)
+	if flags&0x1 != 0 {
+		b = binary.BigEndian.AppendUint32(b, uint32(frames))
+	}
+	if flags&0x2 != 0 {
+		b = binary.BigEndian.AppendUint32(b, 123456)
+	}
+	if flags&0x4 != 0 {
+		b = append(b, make([]byte, 100)...)
+	}
+	if flags&0x8 != 0 {
+		b = binary.BigEndian.AppendUint32(b, 57)
+	}
+	if encoder != "" {
+		ext := make([]byte, 36)
+		copy(ext, encoder)
+		ext[21] = byte(delay >> 4)
+		ext[22] = byte(delay<<4) | byte(padding>>8)
+		ext[23] = byte(padding)
+		b = append(b, ext...)
+	}
+	return b
+}
+
+// vbriFrame builds a frame with a VBRI tag, always 32 bytes in
+func vbriFrame(frames int) []byte {
+	b := mp3FrameBytes(false, nil)
+	copy(b[36:], "VBRI")
+	binary.BigEndian.PutUint32(b[50:], uint32(frames))
+	return b
+}
+
+// decodeFrames decodes raw frames with the mp3 decoder the streamer uses
+func decodeFrames(t *testing.T, raw ...[]byte) []*mp3.Frame {
+	dec := mp3.NewDecoder(bytes.NewReader(bytes.Join(raw, nil)))
+	var frames []*mp3.Frame
+	for range raw {
+		f := new(mp3.Frame)
+		var skipped int
+		if err := dec.Decode(f, &skipped); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func TestParseXing(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		ok    bool
+		info  xingInfo
+	}{
+		{"Xing with LAME", mp3FrameBytes(false, xingTag("Xing", 0x1, 1000, "LAME3.100", 576, 1200)), true, xingInfo{1000, 576, 1200}},
+		{"Info with every field and Lavf", mp3FrameBytes(false, xingTag("Info", 0xf, 77, "Lavf58.76", 1105, 4095)), true, xingInfo{77, 1105, 4095}},
+		{"mono", mp3FrameBytes(true, xingTag("Info", 0x1, 5, "LAME3.99r", 576, 0)), true, xingInfo{5, 576, 0}},
+		{"no frame count", mp3FrameBytes(false, xingTag("Xing", 0x6, 0, "LAME3.100", 576, 300)), true, xingInfo{0, 576, 300}},
+		{"unknown encoder", mp3FrameBytes(false, xingTag("Xing", 0x1, 9, "XYZ", 576, 300)), true, xingInfo{9, 0, 0}},
+		{"no extension", mp3FrameBytes(false, xingTag("Info", 0x1, 9, "", 0, 0)), true, xingInfo{9, 0, 0}},
+		{"VBRI", vbriFrame(4242), true, xingInfo{4242, 0, 0}},
+		{"audio", mp3FrameBytes(false, []byte("just audio")), false, xingInfo{}},
+		{"tag at the stereo offset of a mono frame", mp3FrameBytes(true, append(make([]byte, 15), "Xing"...)), false, xingInfo{}},
+	}
+	for _, tt := range tests {
+		f := decodeFrames(t, tt.frame)[0]
+		info, ok := parseXing(f)
+		if ok != tt.ok || info != tt.info {
+			t.Errorf("%s: %+v, %v, want %+v, %v", tt.name, info, ok, tt.info, tt.ok)
+		}
+	}
+}
+
+func TestGaplessKeep(t *testing.T) {
+	audio := mp3FrameBytes(false, []byte("audio"))
+	track := func(frames, delay, padding int) [][]byte {
+		raw := [][]byte{mp3FrameBytes(false, xingTag("Info", 0x1, frames, "LAME3.100", delay, padding))}
+		for i := 0; i < frames; i++ {
+			raw = append(raw, audio)
+		}
+		return raw
+	}
+	tests := []struct {
+		name string
+		raw  [][]byte
+		keep string
+	}{
+		// 2000+529 samples of delay are 2 whole frames of 1152,
+		// 3000-529 of padding 2 more
+		{"delay and padding", track(10, 2000, 3000), "-" + "--" + "111111" + "--"},
+		{"no whole frames to drop", track(4, 576, 1000), "-" + "1111"},
+		{"padding under the decoder delay", track(3, 1200, 100), "-" + "-" + "11"},
+		{"no header", [][]byte{audio, audio}, "11"},
+		{"tracks joined", append(track(3, 2000, 0), track(3, 0, 2000)...), "-" + "--1" + "-" + "11-"},
+		{"audio after the count", append(track(2, 0, 2000), audio, audio), "-" + "1-" + "11"},
+	}
+	for _, tt := range tests {
+		var g gapless
+		var got []byte
+		for _, f := range decodeFrames(t, tt.raw...) {
+			if g.keep(f) {
+				got = append(got, '1')
+			} else {
+				got = append(got, '-')
+			}
+		}
+		if string(got) != tt.keep {
+			t.Errorf("%s: kept %s, want %s", tt.name, got, tt.keep)
+		}
+	}
+}